@@ -0,0 +1,58 @@
+package _integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/knocknote/gotx"
+	rdbms "github.com/knocknote/gotx/rdbms"
+
+	_ "github.com/lib/pq"
+)
+
+func TestCompositeCompensation(t *testing.T) {
+
+	ctx := context.Background()
+	redisTransactor, redisClientProvider := newTransactor()
+	connectionProvider := newConnection()
+	rdbmsTransactor := rdbms.NewTransactor(connectionProvider)
+	// rdbms is the outermost transaction and committed last.
+	transactor := gotx.NewCompositeTransactor(redisTransactor, rdbmsTransactor)
+	key := "test_composite_key1"
+	value := "test_value"
+	e := errors.New("before commit error")
+
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := redisClientProvider.CurrentClient(ctx)
+		if err := writer.Set(key, value, -1).Err(); err != nil {
+			return err
+		}
+		if err := gotx.RegisterCompensation(ctx, "redis", func(ctx context.Context) error {
+			_, writer := redisClientProvider.CurrentClient(ctx)
+			return writer.Del(key).Err()
+		}); err != nil {
+			return err
+		}
+		// make the rdbms commit fail after the redis commit.
+		return gotx.RegisterSynchronization(ctx, gotx.SynchronizationFuncs{
+			OnBeforeCommit: func(ctx context.Context) error {
+				return e
+			},
+		})
+	})
+	var compositeErr *gotx.CompositeError
+	if !errors.As(err, &compositeErr) || !errors.Is(err, e) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+	if len(compositeErr.Committed) != 1 || compositeErr.Committed[0] != "redis" || len(compositeErr.RolledBack) != 1 || compositeErr.RolledBack[0] != "rdbms" {
+		t.Errorf("unexpected result %v", compositeErr)
+		return
+	}
+	reader, _ := redisClientProvider.CurrentClient(ctx)
+	if result, _ := reader.Get(key).Result(); result == value {
+		t.Errorf("compensation expected")
+		return
+	}
+}
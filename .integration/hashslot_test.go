@@ -0,0 +1,159 @@
+package _integration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/knocknote/gotx"
+)
+
+func TestRedisClusterSlot(t *testing.T) {
+	if slot := gotx.RedisClusterSlot([]byte("foo")); slot != 12182 {
+		t.Errorf("unexpected slot %d", slot)
+		return
+	}
+	if gotx.RedisClusterSlot([]byte("{user1000}.following")) != gotx.RedisClusterSlot([]byte("user1000")) {
+		t.Error("hashtag must be used")
+		return
+	}
+	// empty hashtag is ignored
+	if gotx.RedisClusterSlot([]byte("foo{}{bar}")) == gotx.RedisClusterSlot([]byte("bar")) {
+		t.Error("empty hashtag must be ignored")
+		return
+	}
+}
+
+func TestHashSlotRouter(t *testing.T) {
+	router := gotx.NewHashSlotRouter(2, 16383)
+	if index := router.ShardIndex([]byte("user1")); index != 1 {
+		t.Errorf("unexpected index %d", index)
+		return
+	}
+	for _, maxSlot := range []uint32{0, 1} {
+		func() {
+			defer func() {
+				if _, ok := recover().(*gotx.ShardingConfigError); !ok {
+					t.Errorf("maxSlot %d must be rejected", maxSlot)
+				}
+			}()
+			gotx.NewHashSlotRouter(2, maxSlot)
+		}()
+	}
+}
+
+func TestConsistentRouter(t *testing.T) {
+	routers := map[string]func(size int) gotx.ShardRouter{
+		"jump":       gotx.NewJumpHashRouter,
+		"rendezvous": gotx.NewRendezvousRouter,
+		"ketama": func(size int) gotx.ShardRouter {
+			return gotx.NewKetamaRouter(size, 160)
+		},
+	}
+	for name, newRouter := range routers {
+		before := newRouter(4)
+		after := newRouter(5)
+		moved := 0
+		for i := 0; i < 10000; i++ {
+			key := []byte(fmt.Sprintf("user%d", i))
+			from := before.ShardIndex(key)
+			to := after.ShardIndex(key)
+			if from < 0 || from >= 4 || to < 0 || to >= 5 {
+				t.Errorf("%s: unexpected index %d %d", name, from, to)
+				return
+			}
+			if from != to {
+				if to != 4 {
+					t.Errorf("%s: key must be moved to the new shard", name)
+					return
+				}
+				moved++
+			}
+		}
+		if moved == 0 || moved > 4000 {
+			t.Errorf("%s: unexpected moved keys %d", name, moved)
+			return
+		}
+	}
+}
+
+func TestSlotMap(t *testing.T) {
+	slotMap, err := gotx.ParseSlotMapYAML([]byte(`
+maxSlot: 16384
+hash: crc16
+shards:
+  - shard: 0
+    ranges:
+      - start: 0
+        end: 5460
+      - start: 10923
+        end: 16383
+  - shard: 1
+    ranges:
+      - start: 5461
+        end: 10922
+`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router, err := slotMap.Router()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// slot of foo is 12182
+	if index := router.ShardIndex([]byte("foo")); index != 0 {
+		t.Errorf("unexpected index %d", index)
+		return
+	}
+
+	invalid := []string{
+		`{"maxSlot": 10, "shards": [{"shard": 0, "ranges": [{"start": 0, "end": 4}]}, {"shard": 1, "ranges": [{"start": 6, "end": 9}]}]}`,
+		`{"maxSlot": 10, "shards": [{"shard": 0, "ranges": [{"start": 0, "end": 5}]}, {"shard": 1, "ranges": [{"start": 5, "end": 9}]}]}`,
+		`{"maxSlot": 10, "shards": [{"shard": 0, "ranges": [{"start": 0, "end": 9}]}, {"shard": 1}]}`,
+	}
+	for _, data := range invalid {
+		if _, err = gotx.ParseSlotMapJSON([]byte(data)); err == nil {
+			t.Errorf("must error %s", data)
+			return
+		}
+	}
+
+	router, err = gotx.NewWeightedSlotMap(100, 1, 3).Router()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	counts := make([]int, 2)
+	for i := 0; i < 10000; i++ {
+		counts[router.ShardIndex([]byte(fmt.Sprintf("user%d", i)))]++
+	}
+	if counts[0] > counts[1]/2 {
+		t.Errorf("unexpected weighted distribution %v", counts)
+		return
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	router, err := gotx.NewMigratingShardRouter(gotx.NewWeightedSlotMap(100, 1, 1), gotx.NewWeightedSlotMap(100, 1, 1, 2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 0-49 => 0, 50-99 => 1 is changed to 0-24 => 0, 25-49 => 1, 50-99 => 2
+	migrations := router.Migrations()
+	if len(migrations) != 75 {
+		t.Errorf("unexpected migrations %d", len(migrations))
+		return
+	}
+	for _, m := range migrations {
+		expected := gotx.SlotMigration{Slot: m.Slot, From: 0, To: 1}
+		if m.Slot >= 50 {
+			expected = gotx.SlotMigration{Slot: m.Slot, From: 1, To: 2}
+		}
+		if m.Slot < 25 || m != expected {
+			t.Errorf("unexpected migration %v", m)
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package _integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/knocknote/gotx/outbox"
+	rdbms "github.com/knocknote/gotx/rdbms"
+
+	_ "github.com/lib/pq"
+)
+
+func TestOutbox(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	connection := connectionProvider.CurrentConnection(ctx)
+	_, _ = connection.Exec("drop table outbox")
+	_, _ = connection.Exec("drop table outbox_keys")
+	if _, err := connection.Exec(`create table outbox ( seq bigserial not null unique, id varchar(32) primary key, topic varchar(255) not null, message_key varchar(255) not null, payload bytea not null, created_at bigint not null, sent_at bigint)`); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := connection.Exec(`create table outbox_keys ( message_key varchar(255) primary key, version bigint not null)`); err != nil {
+		t.Error(err)
+		return
+	}
+	store := outbox.NewRDBMSStore(clientProvider, outbox.RDBMSStoreConfig{})
+	messages := outbox.New(store)
+
+	if err := messages.Enqueue(ctx, "topic", []byte("no transaction")); err == nil {
+		t.Error("transaction must be required")
+		return
+	}
+	// the transaction of the other backend is not the transaction of the store.
+	redisTransactor, _ := newTransactor()
+	if err := redisTransactor.Required(ctx, func(ctx context.Context) error {
+		return messages.Enqueue(ctx, "topic", []byte("redis transaction"))
+	}); err == nil {
+		t.Error("rdbms transaction must be required")
+		return
+	}
+	_ = transactor.Required(ctx, func(ctx context.Context) error {
+		_ = messages.Enqueue(ctx, "topic", []byte("rollback"))
+		return errors.New("error")
+	})
+	for _, payload := range []string{"a1", "b1", "a2"} {
+		err := transactor.Required(ctx, func(ctx context.Context) error {
+			return messages.EnqueueWithKey(ctx, "topic", payload[:1], []byte(payload))
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var published []string
+	failed := true
+	relay := outbox.NewRelay(store, outbox.PublisherFunc(func(ctx context.Context, message *outbox.Message) error {
+		if string(message.Payload) == "a1" && failed {
+			failed = false
+			return errors.New("publish error")
+		}
+		published = append(published, string(message.Payload))
+		return nil
+	}), outbox.RelayConfig{})
+
+	if sent, err := relay.RelayOnce(ctx); err == nil || sent != 1 {
+		t.Errorf("unexpected result sent=%d err=%v", sent, err)
+		return
+	}
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 2 {
+		t.Errorf("unexpected result sent=%d err=%v", sent, err)
+		return
+	}
+	if len(published) != 3 || published[0] != "b1" || published[1] != "a1" || published[2] != "a2" {
+		t.Errorf("unexpected order %v", published)
+		return
+	}
+
+	// the writer of the same key waits for the previous transaction, whose seq is assigned first, to commit.
+	published = nil
+	second := make(chan error, 1)
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		if err := messages.EnqueueWithKey(ctx, "topic", "a", []byte("a3")); err != nil {
+			return err
+		}
+		go func() {
+			second <- transactor.Required(context.Background(), func(ctx context.Context) error {
+				return messages.EnqueueWithKey(ctx, "topic", "a", []byte("a4"))
+			})
+		}()
+		select {
+		case err := <-second:
+			return fmt.Errorf("the second writer must wait %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = <-second; err != nil {
+		t.Error(err)
+		return
+	}
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 2 {
+		t.Errorf("unexpected result sent=%d err=%v", sent, err)
+		return
+	}
+	if len(published) != 2 || published[0] != "a3" || published[1] != "a4" {
+		t.Errorf("unexpected order %v", published)
+		return
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/knocknote/gotx"
 
 	rdbms "github.com/knocknote/gotx/rdbms"
+	gotxredis "github.com/knocknote/gotx/redis"
 
 	_ "github.com/lib/pq"
 )
@@ -187,3 +188,490 @@ func TestReadOnlyOption(t *testing.T) {
 	}
 
 }
+
+func TestMandatory(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+
+	err := transactor.Mandatory(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	var stateErr *gotx.IllegalTransactionStateError
+	if !errors.As(err, &stateErr) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		return transactor.Mandatory(ctx, func(ctx context.Context) error {
+			if gotx.CurrentStatus(ctx).IsNewTransaction() {
+				return errors.New("mandatory scope must join the transaction")
+			}
+			return transactor.Supports(ctx, func(ctx context.Context) error {
+				if gotx.CurrentStatus(ctx).IsNewTransaction() {
+					return errors.New("supports scope must join the transaction")
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestNever(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return transactor.Never(ctx, func(ctx context.Context) error {
+			return nil
+		})
+	})
+	var stateErr *gotx.IllegalTransactionStateError
+	if !errors.As(err, &stateErr) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+}
+
+func TestNotSupported(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	if err := createTable(ctx, connectionProvider, "test6"); err != nil {
+		t.Error(err)
+		return
+	}
+	_ = transactor.Required(ctx, func(ctx context.Context) error {
+		client := clientProvider.CurrentClient(ctx)
+		_, _ = client.Exec("INSERT into test6 values('1')")
+		_ = transactor.NotSupported(ctx, func(ctx context.Context) error {
+			client2 := clientProvider.CurrentClient(ctx)
+			_, _ = client2.Exec("INSERT into test6 values('2')")
+			return nil
+		})
+		return errors.New("outer transaction failed")
+	})
+
+	client := clientProvider.CurrentClient(ctx)
+	var id string
+	err := client.QueryRow("SELECT id FROM test6 where id = '1'").Scan(&id)
+	if err == nil {
+		t.Error("id 1 must be rollback")
+		return
+	}
+	err = client.QueryRow("SELECT * FROM test6 where id = '2'").Scan(&id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestNested(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactorWithConfig(connectionProvider, rdbms.TransactorConfig{
+		SavepointDialect: &rdbms.PostgresDialect{},
+	})
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	if err := createTable(ctx, connectionProvider, "test7"); err != nil {
+		t.Error(err)
+		return
+	}
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		client := clientProvider.CurrentClient(ctx)
+		if _, err := client.Exec("INSERT into test7 values('1')"); err != nil {
+			return err
+		}
+		_ = transactor.Nested(ctx, func(ctx context.Context) error {
+			client2 := clientProvider.CurrentClient(ctx)
+			_, _ = client2.Exec("INSERT into test7 values('2')")
+			return errors.New("nested transaction failed")
+		})
+		return transactor.Nested(ctx, func(ctx context.Context) error {
+			client3 := clientProvider.CurrentClient(ctx)
+			_, err := client3.Exec("INSERT into test7 values('3')")
+			return err
+		})
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := clientProvider.CurrentClient(ctx)
+	var id string
+	if err = client.QueryRow("SELECT id FROM test7 where id = '1'").Scan(&id); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = client.QueryRow("SELECT id FROM test7 where id = '2'").Scan(&id); err == nil {
+		t.Error("id 2 must be rollback")
+		return
+	}
+	if err = client.QueryRow("SELECT id FROM test7 where id = '3'").Scan(&id); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestIsolationOption(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+
+	// the options of the other backends do not overwrite the isolation level
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		var level string
+		if err := clientProvider.CurrentClient(ctx).QueryRow("SHOW TRANSACTION ISOLATION LEVEL").Scan(&level); err != nil {
+			return err
+		}
+		if level != "serializable" {
+			return fmt.Errorf("unexpected isolation level %s", level)
+		}
+		return nil
+	}, rdbms.OptionIsolation(sql.LevelSerializable), gotxredis.OptionOverlay())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		return transactor.Required(ctx, func(ctx context.Context) error {
+			return nil
+		}, rdbms.OptionIsolation(sql.LevelSerializable))
+	}, rdbms.OptionIsolation(sql.LevelReadCommitted))
+	var isolationErr *rdbms.IsolationLevelError
+	if !errors.As(err, &isolationErr) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+}
+
+func TestNoRollbackForOption(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	if err := createTable(ctx, connectionProvider, "test8"); err != nil {
+		t.Error(err)
+		return
+	}
+	e := errors.New("business error")
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		client := clientProvider.CurrentClient(ctx)
+		if _, err := client.Exec("INSERT into test8 values('1')"); err != nil {
+			return err
+		}
+		return fmt.Errorf("wrapped: %w", e)
+	}, gotx.OptionNoRollbackFor(e))
+	if !errors.Is(err, e) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+	client := clientProvider.CurrentClient(ctx)
+	var id string
+	if err = client.QueryRow("SELECT id FROM test8 where id = '1'").Scan(&id); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestSetRollbackOnly(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	if err := createTable(ctx, connectionProvider, "test9"); err != nil {
+		t.Error(err)
+		return
+	}
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		if !gotx.CurrentStatus(ctx).IsNewTransaction() {
+			return errors.New("outer scope must be new transaction")
+		}
+		client := clientProvider.CurrentClient(ctx)
+		if _, err := client.Exec("INSERT into test9 values('1')"); err != nil {
+			return err
+		}
+		return transactor.Required(ctx, func(ctx context.Context) error {
+			status := gotx.CurrentStatus(ctx)
+			if status.IsNewTransaction() {
+				return errors.New("inner scope must join the transaction")
+			}
+			status.SetRollbackOnly()
+			return nil
+		})
+	}, gotx.OptionName("test9"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client := clientProvider.CurrentClient(ctx)
+	var id string
+	if err = client.QueryRow("SELECT id FROM test9 where id = '1'").Scan(&id); err == nil {
+		t.Error("id 1 must be rollback")
+		return
+	}
+}
+
+func TestSynchronization(t *testing.T) {
+
+	ctx := context.Background()
+	connectionProvider := newConnection()
+	transactor := rdbms.NewTransactor(connectionProvider)
+	var events []string
+	sync := func(name string) gotx.Synchronization {
+		return gotx.SynchronizationFuncs{
+			OnAfterCommit: func(ctx context.Context) {
+				events = append(events, name+":commit")
+			},
+			OnAfterRollback: func(ctx context.Context) {
+				events = append(events, name+":rollback")
+			},
+		}
+	}
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		if err := gotx.RegisterSynchronization(ctx, sync("outer")); err != nil {
+			return err
+		}
+		err := transactor.Required(ctx, func(ctx context.Context) error {
+			return gotx.RegisterSynchronization(ctx, sync("inner"))
+		})
+		if len(events) != 0 {
+			return errors.New("synchronization must be deferred to the outermost transaction")
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fmt.Sprint(events) != "[outer:commit inner:commit]" {
+		t.Errorf("unexpected events %v", events)
+		return
+	}
+
+	events = nil
+	_ = transactor.Required(ctx, func(ctx context.Context) error {
+		_ = gotx.RegisterSynchronization(ctx, sync("tx"))
+		return errors.New("error")
+	})
+	if fmt.Sprint(events) != "[tx:rollback]" {
+		t.Errorf("unexpected events %v", events)
+		return
+	}
+
+	if err = gotx.RegisterSynchronization(ctx, sync("none")); err != gotx.ErrSynchronizationNotActive {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+}
+
+func TestReplicaAwareConnection(t *testing.T) {
+
+	ctx := context.Background()
+	// the second database stands in for the replica
+	_, _, cons, _ := newShardingConnection()
+	if err := createShardingTable(ctx, cons, "test10"); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cons[1].Exec("INSERT into test10 values('replica')"); err != nil {
+		t.Error(err)
+		return
+	}
+	healthy := true
+	connectionProvider := rdbms.NewReplicaAwareConnectionProvider(cons[0], []*sql.DB{cons[1]}, rdbms.ReplicaConfig{
+		Balancer: rdbms.NewLeastConnectionsBalancer(),
+		HealthCheck: func(ctx context.Context, replica *sql.DB) error {
+			if !healthy {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	count := func(ctx context.Context) (int, error) {
+		var count int
+		err := clientProvider.CurrentClient(ctx).QueryRow("SELECT count(*) FROM test10").Scan(&count)
+		return count, err
+	}
+
+	tests := []struct {
+		healthy  bool
+		options  []gotx.Option
+		expected int
+	}{
+		{healthy: true, options: []gotx.Option{gotx.OptionReadOnly()}, expected: 1},
+		{healthy: true, expected: 0},
+		{healthy: false, options: []gotx.Option{gotx.OptionReadOnly()}, expected: 0},
+	}
+	for _, test := range tests {
+		healthy = test.healthy
+		connectionProvider.CheckHealth(ctx)
+		var actual int
+		err := transactor.Required(ctx, func(ctx context.Context) error {
+			var err error
+			actual, err = count(ctx)
+			return err
+		}, test.options...)
+		if err != nil || actual != test.expected {
+			t.Errorf("unexpected count %d %v", actual, err)
+			return
+		}
+	}
+
+	// reads without the transaction
+	healthy = true
+	connectionProvider.CheckHealth(ctx)
+	err := transactor.NotSupported(ctx, func(ctx context.Context) error {
+		actual, err := count(ctx)
+		if err == nil && actual != 1 {
+			return fmt.Errorf("must read the replica %d", actual)
+		}
+		return err
+	}, gotx.OptionReadOnly())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+
+	ctx := context.Background()
+	// the second database stands in for the replica, which never replays the position of the primary.
+	_, _, cons, _ := newShardingConnection()
+	if err := createShardingTable(ctx, cons, "test11"); err != nil {
+		t.Error(err)
+		return
+	}
+	connectionProvider := rdbms.NewReplicaAwareConnectionProvider(cons[0], []*sql.DB{cons[1]}, rdbms.ReplicaConfig{
+		Consistency: &rdbms.ConsistencyConfig{
+			Dialect: &rdbms.PostgresReplicationDialect{},
+			SessionKeyProvider: func(ctx context.Context) string {
+				userID, _ := ctx.Value(shardKeyUser).(string)
+				return userID
+			},
+		},
+	})
+	transactor := rdbms.NewTransactor(connectionProvider)
+	clientProvider := rdbms.NewDefaultClientProvider(connectionProvider)
+	count := func(ctx context.Context) int {
+		var count int
+		_ = clientProvider.CurrentClient(rdbms.WithReadOnly(ctx)).QueryRow("SELECT count(*) FROM test11").Scan(&count)
+		return count
+	}
+
+	writer := context.WithValue(ctx, shardKeyUser, "user1")
+	err := transactor.Required(writer, func(ctx context.Context) error {
+		_, err := clientProvider.CurrentClient(ctx).Exec("INSERT into test11 values('1')")
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	token, ok := connectionProvider.SessionToken(writer)
+	if !ok || token.Position == "" {
+		t.Errorf("token must be remembered %v", token)
+		return
+	}
+	if actual := count(writer); actual != 1 {
+		t.Errorf("writer must read the primary %d", actual)
+		return
+	}
+	if actual := count(context.WithValue(ctx, shardKeyUser, "user2")); actual != 0 {
+		t.Errorf("other session must read the replica %d", actual)
+		return
+	}
+
+	// the token travels to the other request
+	parsed, err := rdbms.ParseSessionToken(token.String())
+	if err != nil || parsed != token {
+		t.Errorf("unexpected token %v %v", parsed, err)
+		return
+	}
+	if actual := count(rdbms.WithSessionToken(ctx, parsed)); actual != 1 {
+		t.Errorf("request with the token must read the primary %d", actual)
+		return
+	}
+	// the later position of the stored token wins over the older token of the client
+	err = transactor.Required(writer, func(ctx context.Context) error {
+		_, err := clientProvider.CurrentClient(ctx).Exec("INSERT into test11 values('3')")
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	latest, _ := connectionProvider.SessionToken(writer)
+	if actual, ok := connectionProvider.SessionToken(rdbms.WithSessionToken(writer, parsed)); !ok || actual != latest || actual == parsed {
+		t.Errorf("the later token must be used %v %v %v", actual, latest, parsed)
+		return
+	}
+	// the token is ignored without the consistency
+	withoutConsistency := rdbms.NewReplicaAwareConnectionProvider(cons[0], []*sql.DB{cons[1]}, rdbms.ReplicaConfig{})
+	if conn := withoutConsistency.CurrentConnection(rdbms.WithReadOnly(rdbms.WithSessionToken(ctx, parsed))); conn != cons[1] {
+		t.Error("the token must be ignored without the consistency")
+		return
+	}
+
+	// no token is remembered without SessionKeyProvider
+	shared := rdbms.NewReplicaAwareConnectionProvider(cons[0], []*sql.DB{cons[1]}, rdbms.ReplicaConfig{
+		Consistency: &rdbms.ConsistencyConfig{
+			Dialect: &rdbms.PostgresReplicationDialect{},
+		},
+	})
+	err = rdbms.NewTransactor(shared).Required(writer, func(ctx context.Context) error {
+		_, err := rdbms.NewDefaultClientProvider(shared).CurrentClient(ctx).Exec("INSERT into test11 values('2')")
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := shared.SessionToken(writer); ok {
+		t.Error("the token must not be remembered")
+		return
+	}
+	if conn := shared.CurrentConnection(rdbms.WithReadOnly(ctx)); conn != cons[1] {
+		t.Error("the request without the token must read the replica")
+		return
+	}
+}
+
+func TestLatestPosition(t *testing.T) {
+
+	entries := []struct {
+		dialect  rdbms.ReplicationDialect
+		a        string
+		b        string
+		expected string
+	}{
+		{&rdbms.PostgresReplicationDialect{}, "16/B374D848", "16/B374D850", "16/B374D850"},
+		{&rdbms.PostgresReplicationDialect{}, "17/0", "16/FFFFFFFF", "17/0"},
+		{&rdbms.MySQLReplicationDialect{}, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-7,\n4e11fa47-71ca-11e1-9e33-c80aa9429562:3", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-7,4e11fa47-71ca-11e1-9e33-c80aa9429562:3"},
+		{&rdbms.MySQLReplicationDialect{}, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3:8", "3e11fa47-71ca-11e1-9e33-c80aa9429562:4-5", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:8"},
+	}
+	for _, entry := range entries {
+		if actual, err := entry.dialect.LatestPosition(entry.a, entry.b); err != nil || actual != entry.expected {
+			t.Errorf("unexpected position %s %v", actual, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package _integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knocknote/gotx"
+	rdbms "github.com/knocknote/gotx/rdbms"
+
+	_ "github.com/lib/pq"
+)
+
+func TestXACommit(t *testing.T) {
+
+	ctx := context.Background()
+	users, _, userCons, _ := newShardingConnection()
+	var maxPrepared int
+	if err := userCons[0].QueryRow("SHOW max_prepared_transactions").Scan(&maxPrepared); err != nil || maxPrepared == 0 {
+		t.Skip("max_prepared_transactions is required")
+	}
+	if err := createShardingTable(ctx, userCons, "user_xa"); err != nil {
+		t.Error(err)
+		return
+	}
+	dir, err := ioutil.TempDir("", "gotx")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	transactor := rdbms.NewXATransactor(userCons, users, rdbms.XATransactorConfig{
+		Dialect:       &rdbms.PostgresXADialect{},
+		Log:           rdbms.NewFileCoordinatorLog(filepath.Join(dir, "xa.log")),
+		CoordinatorID: "test",
+	})
+	if err = transactor.Recover(ctx); err != nil {
+		t.Error(err)
+		return
+	}
+	clientProvider := rdbms.NewShardingDefaultClientProvider(users, userShardKeyProvider)
+
+	insert := func(ctx context.Context, userID string) error {
+		_, err := clientProvider.CurrentClient(context.WithValue(ctx, shardKeyUser, userID)).Exec("INSERT into user_xa values($1)", userID)
+		return err
+	}
+	// user6 is in the first shard and user1 is in the second shard.
+	_ = transactor.Required(ctx, func(ctx context.Context) error {
+		if err := insert(ctx, "user6"); err != nil {
+			return err
+		}
+		if err := insert(ctx, "user1"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		if err := insert(ctx, "user8"); err != nil {
+			return err
+		}
+		return insert(ctx, "user2")
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, expected := range []string{"user8", "user2"} {
+		var id string
+		if err = userCons[i].QueryRow("SELECT id FROM user_xa").Scan(&id); err != nil || id != expected {
+			t.Errorf("unexpected row %s %v", id, err)
+			return
+		}
+	}
+}
+
+func TestXARecoverOwnTransactions(t *testing.T) {
+
+	ctx := context.Background()
+	_, _, userCons, _ := newShardingConnection()
+	var maxPrepared int
+	if err := userCons[0].QueryRow("SHOW max_prepared_transactions").Scan(&maxPrepared); err != nil || maxPrepared == 0 {
+		t.Skip("max_prepared_transactions is required")
+	}
+	dir, err := ioutil.TempDir("", "gotx")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// in-doubt transaction of the other coordinator
+	conn, err := userCons[0].Conn(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	xid := "gotx-other-00000000000000000000000000000000-0"
+	if _, err = conn.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = conn.ExecContext(ctx, "PREPARE TRANSACTION '"+xid+"'"); err != nil {
+		t.Error(err)
+		return
+	}
+	defer userCons[0].Exec("ROLLBACK PREPARED '" + xid + "'")
+
+	transactor := rdbms.NewXATransactor(userCons, nil, rdbms.XATransactorConfig{
+		Dialect:       &rdbms.PostgresXADialect{},
+		Log:           rdbms.NewFileCoordinatorLog(filepath.Join(dir, "xa.log")),
+		CoordinatorID: "test",
+	})
+	if err = transactor.Recover(ctx); err != nil {
+		t.Error(err)
+		return
+	}
+	var count int
+	if err = userCons[0].QueryRow("SELECT count(*) FROM pg_prepared_xacts WHERE gid = $1", xid).Scan(&count); err != nil || count != 1 {
+		t.Errorf("the transaction of the other coordinator must not be touched %d %v", count, err)
+		return
+	}
+}
+
+func TestXACoordinatorID(t *testing.T) {
+
+	for _, id := range []string{"", "app-1", "app'1"} {
+		func() {
+			defer func() {
+				var configErr *gotx.ShardingConfigError
+				if p := recover(); p == nil || !errors.As(p.(error), &configErr) {
+					t.Errorf("%q must be rejected: %v", id, p)
+				}
+			}()
+			rdbms.NewXATransactor(nil, nil, rdbms.XATransactorConfig{CoordinatorID: id})
+		}()
+	}
+}
+
+func TestXAUnsupportedOption(t *testing.T) {
+
+	transactor := rdbms.NewXATransactor(nil, nil, rdbms.XATransactorConfig{CoordinatorID: "test"})
+	for _, option := range []gotx.Option{gotx.OptionReadOnly(), rdbms.OptionIsolation(sql.LevelSerializable)} {
+		called := false
+		err := transactor.Required(context.Background(), func(ctx context.Context) error {
+			called = true
+			return nil
+		}, option)
+		var optionErr *rdbms.UnsupportedOptionError
+		if !errors.As(err, &optionErr) || called {
+			t.Errorf("the option must be rejected: %v", err)
+		}
+	}
+}
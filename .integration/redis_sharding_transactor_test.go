@@ -3,7 +3,9 @@ package _integration
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/knocknote/gotx"
 
@@ -118,3 +120,146 @@ func expectedRedisResult(t *testing.T, user1Exists bool, user2Exists bool, userC
 	}
 
 }
+
+func TestRedisShardingReload(t *testing.T) {
+
+	connectionProvider, pools := newShardingRedisConnection()
+	ctx := context.WithValue(context.Background(), shardKeyUser, "user2")
+	transactor := gotxredis.NewShardingTransactor(connectionProvider, userShardKeyProvider)
+	clientProvider := gotxredis.NewShardingDefaultClientProvider(connectionProvider, userShardKeyProvider)
+	provider := connectionProvider.(*gotxredis.ShardingConnectionProvider)
+
+	// user2 is in the second shard.
+	newClient := redis.NewClient(&redis.Options{
+		Addr: "localhost:6380",
+	})
+	reloaded := make(chan error, 1)
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		go func() {
+			reloaded <- provider.Reload(context.Background(), gotxredis.Topology{
+				DB:     []redis.UniversalClient{pools[0], newClient},
+				Router: gotx.NewHashSlotRouter(2, 16383),
+			})
+		}()
+		// the pipeline holds no connection until EXEC, but the removed connection is not closed in the transaction.
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case err := <-reloaded:
+			return fmt.Errorf("reload must wait for the transaction: %v", err)
+		default:
+		}
+		return writer.Set(testKey, testValue, -1).Err()
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = <-reloaded; err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pools[1].Ping().Err(); err == nil {
+		t.Error("removed connection must be closed")
+		return
+	}
+	if value, err := newClient.Get(testKey).Result(); err != nil || value != testValue {
+		t.Errorf("unexpected value %s %v", value, err)
+		return
+	}
+}
+
+func TestRedisShardingStrictShardKey(t *testing.T) {
+
+	connectionProvider, _ := newShardingRedisConnection()
+	ctx := context.Background()
+	transactor := gotxredis.NewShardingTransactor(connectionProvider, gotx.StrictShardKeyProvider)
+	clientProvider := gotxredis.NewShardingDefaultClientProvider(connectionProvider, gotx.StrictShardKeyProvider).(*gotxredis.DefaultClientProvider)
+
+	var notFound *gotx.ShardKeyNotFoundError
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	if !errors.As(err, &notFound) {
+		t.Errorf("must be shard key error %v", err)
+		return
+	}
+	if _, _, err = clientProvider.ResolveClient(ctx); !errors.As(err, &notFound) {
+		t.Errorf("must be shard key error %v", err)
+		return
+	}
+	if err = clientProvider.Watch(ctx, testKey); !errors.As(err, &notFound) {
+		t.Errorf("must be shard key error %v", err)
+		return
+	}
+}
+
+func TestRedisMigrationSecondaryAfterCommit(t *testing.T) {
+
+	_, pools := newShardingRedisConnection()
+	router, err := gotx.NewMigratingShardRouter(gotx.NewWeightedSlotMap(16384, 1), gotx.NewWeightedSlotMap(16384, 1, 1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	connectionProvider := gotxredis.NewMigratingConnectionProvider(pools, router, userShardKeyProvider)
+	transactor := gotxredis.NewShardingTransactor(connectionProvider, userShardKeyProvider)
+	var reported *gotxredis.SecondaryWriteError
+	clientProvider := gotxredis.NewMigratingClientProviderWithConfig(connectionProvider, userShardKeyProvider, gotxredis.MigratingClientProviderConfig{
+		OnSecondaryError: func(ctx context.Context, err *gotxredis.SecondaryWriteError) {
+			reported = err
+		},
+	})
+
+	// find the key moved to the new shard
+	userID := ""
+	for i := 0; userID == ""; i++ {
+		key := fmt.Sprintf("user%d", i)
+		if len(router.WriteShards([]byte(key))) == 2 {
+			userID = key
+		}
+	}
+	ctx := context.WithValue(context.Background(), shardKeyUser, userID)
+	incr := func(ctx context.Context) error {
+		writers, err := clientProvider.WriteClients(ctx)
+		if err != nil {
+			return err
+		}
+		for _, writer := range writers {
+			writer.Incr(testKey)
+		}
+		return nil
+	}
+
+	// the old shard is not written when the new shard rolls back.
+	_ = transactor.Required(ctx, func(ctx context.Context) error {
+		if err := incr(ctx); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	for _, pool := range pools {
+		if exists := pool.Exists(testKey).Val(); exists != 0 {
+			t.Error("must not be written after rollback")
+			return
+		}
+	}
+
+	// the failure of the old shard is reported after the new shard is committed.
+	if err = pools[0].Set(testKey, testValue, -1).Err(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = transactor.Required(ctx, incr); err != nil {
+		t.Error(err)
+		return
+	}
+	if value := pools[1].Get(testKey).Val(); value != "1" {
+		t.Errorf("the new shard must be committed %s", value)
+		return
+	}
+	if reported == nil || len(reported.Cmds) == 0 {
+		t.Errorf("the failure of the old shard must be reported %v", reported)
+		return
+	}
+}
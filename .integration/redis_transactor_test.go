@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/knocknote/gotx"
 	gotxredis "github.com/knocknote/gotx/redis"
@@ -139,3 +140,399 @@ func TestRedisRollbackOption(t *testing.T) {
 		return
 	}
 }
+
+func TestRedisNestedNotSupported(t *testing.T) {
+
+	ctx := context.Background()
+	transactor, _ := newTransactor()
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return transactor.Nested(ctx, func(ctx context.Context) error {
+			return nil
+		})
+	})
+	var nestedErr *gotx.NestedTransactionNotSupportedError
+	if !errors.As(err, &nestedErr) {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+}
+
+func TestRedisNoRollbackForOption(t *testing.T) {
+
+	ctx := context.Background()
+	transactor, clientProvider := newTransactor()
+	key := "test_key5"
+	value := "test_value"
+	e := errors.New("business error")
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		_ = writer.Set(key, value, -1).Err()
+		return e
+	}, gotx.OptionNoRollbackFor(e))
+	if err != e {
+		t.Errorf("unexpected error %v", err)
+		return
+	}
+	reader, _ := clientProvider.CurrentClient(ctx)
+	result, _ := reader.Get(key).Result()
+	if result != value {
+		t.Errorf("expected=%s, but actual=%s", value, result)
+		return
+	}
+}
+
+func TestRedisWatchOption(t *testing.T) {
+
+	ctx := context.Background()
+	transactor, clientProvider := newTransactor()
+	other := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	key := "test_key6"
+	if err := other.Set(key, 0, -1).Err(); err != nil {
+		t.Error(err)
+		return
+	}
+	attempts := 0
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		attempts++
+		reader, writer := clientProvider.CurrentClient(ctx)
+		value, err := reader.Get(key).Int()
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// modified by the other client before EXEC
+			if err = other.Incr(key).Err(); err != nil {
+				return err
+			}
+		}
+		return writer.Set(key, value+10, -1).Err()
+	}, gotxredis.OptionWatch(key), gotxredis.OptionWatchRetry(2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if attempts != 2 {
+		t.Errorf("must be retried %d", attempts)
+		return
+	}
+	if value, _ := other.Get(key).Int(); value != 11 {
+		t.Errorf("unexpected value %d", value)
+		return
+	}
+
+	// dynamic watch
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		if err := clientProvider.(*gotxredis.DefaultClientProvider).Watch(ctx, key); err != nil {
+			return err
+		}
+		if err := other.Incr(key).Err(); err != nil {
+			return err
+		}
+		_, writer := clientProvider.CurrentClient(ctx)
+		return writer.Set(key, 0, -1).Err()
+	}, gotxredis.OptionWatchRetry(1))
+	if err != redis.TxFailedErr {
+		t.Errorf("must fail %v", err)
+		return
+	}
+	if err = clientProvider.(*gotxredis.DefaultClientProvider).Watch(ctx, key); err != gotxredis.ErrNotWatching {
+		t.Errorf("must not watch %v", err)
+		return
+	}
+}
+
+func TestRedisOverlay(t *testing.T) {
+
+	ctx := context.Background()
+	transactor, clientProvider := newTransactor()
+	key := "test_key7"
+	hashKey := "test_key7_hash"
+	var results []redis.Cmder
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		reader, writer := clientProvider.CurrentClient(ctx)
+		if err := writer.Del(key, hashKey).Err(); err != nil {
+			return err
+		}
+		if err := writer.Set(key, 1, -1).Err(); err != nil {
+			return err
+		}
+		if err := writer.Incr(key).Err(); err != nil {
+			return err
+		}
+		if err := writer.HSet(hashKey, "field", "value").Err(); err != nil {
+			return err
+		}
+		// the pending writes are visible before EXEC
+		if value, err := reader.Get(key).Int(); err != nil || value != 2 {
+			t.Errorf("unexpected value %d %v", value, err)
+		}
+		if value, err := reader.HGet(hashKey, "field").Result(); err != nil || value != "value" {
+			t.Errorf("unexpected field %s %v", value, err)
+		}
+		return clientProvider.(*gotxredis.DefaultClientProvider).OnExec(ctx, func(cmds []redis.Cmder) {
+			results = cmds
+		})
+	}, gotxredis.OptionOverlay())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(results) != 4 {
+		t.Errorf("unexpected results %d", len(results))
+		return
+	}
+	if value := results[2].(*redis.IntCmd).Val(); value != 2 {
+		t.Errorf("unexpected incr result %d", value)
+		return
+	}
+
+	// the keys the overlay can not model are tainted
+	listKey := "test_key7_list"
+	errRollback := errors.New("rollback")
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		reader, writer := clientProvider.CurrentClient(ctx)
+		writer.Del(key, hashKey, listKey)
+		writer.Set(key, "text", 10*time.Second)
+		writer.LPush(listKey, "item")
+		if ttl, err := reader.TTL(key).Result(); err != nil || ttl != 10*time.Second {
+			t.Errorf("unexpected ttl %v %v", ttl, err)
+		}
+		if _, err := reader.HGet(key, "field").Result(); err == nil || err == redis.Nil {
+			t.Errorf("must be wrong type %v", err)
+		}
+		if _, err := reader.LRange(listKey, 0, -1).Result(); !errors.As(err, new(*gotxredis.OverlayError)) {
+			t.Errorf("must be tainted %v", err)
+		}
+		writer.Incr(key)
+		if _, err := reader.Get(key).Result(); !errors.As(err, new(*gotxredis.OverlayError)) {
+			t.Errorf("must be tainted %v", err)
+		}
+		// the incr fails at EXEC
+		return errRollback
+	}, gotxredis.OptionOverlay())
+	if err != errRollback {
+		t.Errorf("must rollback %v", err)
+		return
+	}
+}
+
+func TestRedisScriptTransactor(t *testing.T) {
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	connectionProvider := gotxredis.NewDefaultConnectionProvider(client)
+	clientProvider := gotxredis.NewDefaultClientProvider(connectionProvider).(*gotxredis.DefaultClientProvider)
+	transactor := gotxredis.NewScriptTransactor(connectionProvider)
+	key := "test_key8"
+	rankingKey := "test_key8_ranking"
+	if err := client.Set(key, "ready", -1).Err(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := client.ZAdd(rankingKey, redis.Z{Score: 10, Member: "user1"}).Err(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// satisfied
+	var results []redis.Cmder
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		if err := clientProvider.Expect(ctx, gotxredis.ZScoreAtLeast(rankingKey, "user1", 10)); err != nil {
+			return err
+		}
+		_, writer := clientProvider.CurrentClient(ctx)
+		writer.Set(key, "done", -1)
+		writer.ZIncrBy(rankingKey, -10, "user1")
+		return clientProvider.OnExec(ctx, func(cmds []redis.Cmder) {
+			results = cmds
+		})
+	}, gotxredis.OptionExpect(gotxredis.KeyEquals(key, "ready")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(results) != 2 {
+		t.Errorf("unexpected results %d", len(results))
+		return
+	}
+	if value, _ := client.Get(key).Result(); value != "done" {
+		t.Errorf("unexpected value %s", value)
+		return
+	}
+
+	// aborted
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		return writer.Set(key, "aborted", -1).Err()
+	}, gotxredis.OptionExpect(gotxredis.ZScoreAtLeast(rankingKey, "user1", 10)))
+	var precondition *gotxredis.PreconditionFailedError
+	if !errors.As(err, &precondition) {
+		t.Errorf("must abort %v", err)
+		return
+	}
+	if value, _ := client.Get(key).Result(); value != "done" {
+		t.Errorf("must not be written %s", value)
+		return
+	}
+
+	// NOSCRIPT fallback
+	if err = client.ScriptFlush().Err(); err != nil {
+		t.Error(err)
+		return
+	}
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		return writer.Set(key, "reloaded", -1).Err()
+	}, gotxredis.OptionExpect(gotxredis.KeyExists(key)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = clientProvider.Expect(ctx, gotxredis.KeyExists(key)); err != gotxredis.ErrNotScripting {
+		t.Errorf("must not be scripting %v", err)
+		return
+	}
+
+	// the other commands are committed even if a command fails
+	committed := false
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		writer.Incr(key)
+		writer.Set(key+"_after", "written", -1)
+		if err := gotx.RegisterSynchronization(ctx, gotx.SynchronizationFuncs{
+			OnAfterCommit: func(ctx context.Context) {
+				committed = true
+			},
+		}); err != nil {
+			return err
+		}
+		return clientProvider.OnExec(ctx, func(cmds []redis.Cmder) {
+			results = cmds
+		})
+	})
+	var commandErr *gotxredis.ScriptCommandError
+	if !errors.As(err, &commandErr) || commandErr.Index != 0 {
+		t.Errorf("must fail the command %v", err)
+		return
+	}
+	if !committed || len(results) != 2 || results[1].Err() != nil {
+		t.Errorf("must be committed %v %v", committed, results)
+		return
+	}
+}
+
+func TestRedisClusterCrossSlot(t *testing.T) {
+
+	ctx := context.Background()
+	// the slots are checked before connecting to the cluster.
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{"localhost:1"},
+	})
+	defer client.Close()
+	connectionProvider := gotxredis.NewDefaultConnectionProvider(client)
+	clientProvider := gotxredis.NewDefaultClientProvider(connectionProvider)
+	transactor := gotxredis.NewTransactor(connectionProvider)
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		writer.Set("{user1}.profile", "profile", -1)
+		writer.Set("user2.profile", "profile", -1)
+		return nil
+	})
+	var crossSlot *gotxredis.CrossSlotError
+	if !errors.As(err, &crossSlot) {
+		t.Errorf("must be cross slot %v", err)
+		return
+	}
+	if len(crossSlot.Keys) != 2 || crossSlot.Slots[0] == crossSlot.Slots[1] {
+		t.Errorf("unexpected error %v", crossSlot)
+		return
+	}
+
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		_, writer := clientProvider.CurrentClient(ctx)
+		writer.Set("{user1}.profile", "profile", -1)
+		writer.Del("{user1}.items", "{user1}.points")
+		return nil
+	})
+	if errors.As(err, &crossSlot) {
+		t.Errorf("must be the same slot %v", err)
+		return
+	}
+}
+
+func TestRedisClusterWatchKeysRequired(t *testing.T) {
+
+	ctx := context.Background()
+	// the keys are checked before connecting to the cluster.
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{"localhost:1"},
+	})
+	defer client.Close()
+	connectionProvider := gotxredis.NewDefaultConnectionProvider(client)
+	clientProvider := gotxredis.NewDefaultClientProvider(connectionProvider).(*gotxredis.DefaultClientProvider)
+	transactor := gotxredis.NewTransactor(connectionProvider)
+	called := false
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		called = true
+		return clientProvider.Watch(ctx, "{user1}.counter")
+	}, gotxredis.OptionWatchRetry(5))
+	if err != gotxredis.ErrWatchKeysRequired || called {
+		t.Errorf("the dynamic watch without the keys must be rejected on the cluster %v", err)
+		return
+	}
+}
+
+func TestRedisOverlayUnmergedReads(t *testing.T) {
+
+	ctx := context.Background()
+	// the reads of the written keys fail before connecting to the server.
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:1",
+	})
+	defer client.Close()
+	connectionProvider := gotxredis.NewDefaultConnectionProvider(client)
+	clientProvider := gotxredis.NewDefaultClientProvider(connectionProvider)
+	transactor := gotxredis.NewTransactor(connectionProvider)
+	errRollback := errors.New("rollback")
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		reader, writer := clientProvider.CurrentClient(ctx)
+		writer.Del("geo", "stream", "set")
+		writer.SAdd("set", "member")
+		reads := map[string]error{
+			"GeoPos":         reader.GeoPos("geo", "member").Err(),
+			"GeoRadius":      reader.GeoRadius("geo", 0, 0, &redis.GeoRadiusQuery{Radius: 1}).Err(),
+			"XRange":         reader.XRange("stream", "-", "+").Err(),
+			"XRevRange":      reader.XRevRange("stream", "+", "-").Err(),
+			"XRead":          reader.XRead(&redis.XReadArgs{Streams: []string{"stream", "0"}, Block: -1}).Err(),
+			"Keys":           reader.Keys("*").Err(),
+			"Scan":           reader.Scan(0, "*", 10).Err(),
+			"ObjectEncoding": reader.ObjectEncoding("geo").Err(),
+			"MemoryUsage":    reader.MemoryUsage("geo").Err(),
+			"SMembers":       reader.SMembers("set").Err(),
+			"SIsMember":      reader.SIsMember("set", "member").Err(),
+			"Exists":         reader.Exists("set").Err(),
+		}
+		for name, err := range reads {
+			if !errors.As(err, new(*gotxredis.OverlayError)) {
+				t.Errorf("%s must return the overlay error %v", name, err)
+			}
+		}
+		var results []redis.Cmder
+		_, err := reader.Pipelined(func(pipe redis.Pipeliner) error {
+			results = append(results, pipe.XLen("stream"), pipe.ZCard("geo"))
+			return nil
+		})
+		if !errors.As(err, new(*gotxredis.OverlayError)) || !errors.As(results[1].Err(), new(*gotxredis.OverlayError)) {
+			t.Errorf("the pipeline must return the overlay error %v", err)
+		}
+		return errRollback
+	}, gotxredis.OptionOverlay())
+	if err != errRollback {
+		t.Errorf("must rollback %v", err)
+		return
+	}
+}
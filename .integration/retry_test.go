@@ -0,0 +1,209 @@
+package _integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/knocknote/gotx"
+	rdbms "github.com/knocknote/gotx/rdbms"
+	gotxredis "github.com/knocknote/gotx/redis"
+	gotxspanner "github.com/knocknote/gotx/spanner"
+
+	"github.com/go-redis/redis"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errRetryable = errors.New("retryable")
+
+// failingTransactor fails the transaction the given times.
+type failingTransactor struct {
+	failures int
+	attempts int
+}
+
+func (t *failingTransactor) begin(ctx context.Context, fn gotx.DoInTransaction) error {
+	t.attempts++
+	if t.attempts <= t.failures {
+		return errRetryable
+	}
+	return fn(gotx.WithStatus(ctx, gotx.NewTransactionStatus("fake", true, gotx.NewDefaultConfig())))
+}
+
+func (t *failingTransactor) Required(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	if gotx.CurrentStatus(ctx) != nil {
+		t.attempts++
+		return errRetryable
+	}
+	return t.begin(ctx, fn)
+}
+
+func (t *failingTransactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return t.begin(ctx, fn)
+}
+
+func (t *failingTransactor) Supports(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(ctx)
+}
+
+func (t *failingTransactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(ctx)
+}
+
+func (t *failingTransactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(ctx)
+}
+
+func (t *failingTransactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(ctx)
+}
+
+func (t *failingTransactor) Nested(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return t.begin(ctx, fn)
+}
+
+func retryableClassifier() gotx.RetryClassifier {
+	return gotx.RetryClassifierFunc(func(err error) bool {
+		return errors.Is(err, errRetryable)
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	ctx := context.Background()
+	fake := &failingTransactor{failures: 3}
+	transactor := gotx.NewRetryingTransactor(fake, gotx.RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		Multiplier:     2,
+		Classifier:     retryableClassifier(),
+	})
+	start := time.Now()
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fake.attempts != 4 {
+		t.Errorf("unexpected attempts %d", fake.attempts)
+		return
+	}
+	// the jitter is at most 10ms + 20ms + 20ms.
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond+200*time.Millisecond {
+		t.Errorf("backoff exceeds the max backoff %v", elapsed)
+		return
+	}
+
+	// all attempts fail
+	fake = &failingTransactor{failures: 10}
+	transactor = gotx.NewRetryingTransactor(fake, gotx.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Classifier:     retryableClassifier(),
+	})
+	err = transactor.RequiresNew(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	if !errors.Is(err, errRetryable) || fake.attempts != 3 {
+		t.Errorf("unexpected result %v %d", err, fake.attempts)
+		return
+	}
+
+	// not retryable
+	fake = &failingTransactor{}
+	transactor = gotx.NewRetryingTransactor(fake, gotx.RetryPolicy{
+		Classifier: retryableClassifier(),
+	})
+	e := errors.New("not retryable")
+	err = transactor.Required(ctx, func(ctx context.Context) error {
+		return e
+	})
+	if err != e || fake.attempts != 1 {
+		t.Errorf("unexpected result %v %d", err, fake.attempts)
+		return
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	fake := &failingTransactor{failures: 10}
+	transactor := gotx.NewRetryingTransactor(fake, gotx.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 1000 * time.Hour,
+		MaxBackoff:     1000 * time.Hour,
+		Classifier:     retryableClassifier(),
+	})
+	start := time.Now()
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	if !errors.Is(err, errRetryable) || fake.attempts != 1 {
+		t.Errorf("must stop before the deadline %v %d", err, fake.attempts)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("must not wait for the backoff %v", elapsed)
+		return
+	}
+}
+
+func TestRetryJoinedTransaction(t *testing.T) {
+
+	fake := &failingTransactor{}
+	transactor := gotx.NewRetryingTransactor(fake, gotx.RetryPolicy{
+		Classifier: retryableClassifier(),
+	})
+	ctx := gotx.WithStatus(context.Background(), gotx.NewTransactionStatus("rdbms", true, gotx.NewDefaultConfig()))
+	err := transactor.Required(ctx, func(ctx context.Context) error {
+		return nil
+	})
+	if !errors.Is(err, errRetryable) || fake.attempts != 1 {
+		t.Errorf("joined transaction must not be retried %v %d", err, fake.attempts)
+		return
+	}
+}
+
+type mysqlError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *mysqlError) Error() string {
+	return e.Message
+}
+
+func TestRetryClassifier(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		classifier gotx.RetryClassifier
+		err        error
+		retryable  bool
+	}{
+		{"postgres serialization failure", rdbms.NewPostgresRetryClassifier(), &pq.Error{Code: "40001"}, true},
+		{"postgres deadlock wrapped", rdbms.NewPostgresRetryClassifier(), fmt.Errorf("update: %w", &pq.Error{Code: "40P01"}), true},
+		{"postgres unique violation", rdbms.NewPostgresRetryClassifier(), &pq.Error{Code: "23505"}, false},
+		{"mysql deadlock", rdbms.NewMySQLRetryClassifier(), &mysqlError{Number: 1213}, true},
+		{"mysql lock wait timeout wrapped", rdbms.NewMySQLRetryClassifier(), fmt.Errorf("update: %w", &mysqlError{Number: 1205}), true},
+		{"mysql duplicate entry", rdbms.NewMySQLRetryClassifier(), &mysqlError{Number: 1062}, false},
+		{"redis tx failed", gotxredis.NewRetryClassifier(), redis.TxFailedErr, true},
+		{"redis nil", gotxredis.NewRetryClassifier(), redis.Nil, false},
+		{"spanner aborted", gotxspanner.NewRetryClassifier(), status.Error(codes.Aborted, "aborted"), true},
+		{"spanner not found", gotxspanner.NewRetryClassifier(), status.Error(codes.NotFound, "not found"), false},
+		{"plain error", rdbms.NewPostgresRetryClassifier(), errors.New("plain"), false},
+	}
+	for _, test := range tests {
+		if retryable := test.classifier.IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%s: unexpected %v", test.name, retryable)
+		}
+	}
+}
@@ -1,9 +1,50 @@
 package gotx
 
 import (
+	"encoding/binary"
+	"fmt"
 	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
 )
 
+// ShardRouter determines the index of the shard by the shard key.
+type ShardRouter interface {
+	ShardIndex(shardKey []byte) int
+}
+
+// ShardRoutingError is returned when the router can not determine the shard of the key.
+type ShardRoutingError struct {
+	ShardKey string
+	Index    int
+	Size     int
+}
+
+func (e *ShardRoutingError) Error() string {
+	return fmt.Sprintf("shard key %q is routed to index %d of %d shards", e.ShardKey, e.Index, e.Size)
+}
+
+// ShardingConfigError is the invalid configuration of the sharding.
+type ShardingConfigError struct {
+	Reason string
+}
+
+func (e *ShardingConfigError) Error() string {
+	return fmt.Sprintf("invalid sharding config: %s", e.Reason)
+}
+
+// ValidateHashSlot returns error if the shards are empty or maxSlot is less than the number of the shards.
+func ValidateHashSlot(size int, maxSlot uint32) error {
+	if size == 0 {
+		return &ShardingConfigError{Reason: "no shards"}
+	}
+	if maxSlot < uint32(size) {
+		return &ShardingConfigError{Reason: fmt.Sprintf("maxSlot %d is less than %d shards", maxSlot, size)}
+	}
+	return nil
+}
+
 func GetHashSlotRange(size int, maxSlot uint32) []uint32 {
 	average := maxSlot / uint32(size)
 	maxValuePerShard := make([]uint32, size)
@@ -20,6 +61,10 @@ func GetHashSlotRange(size int, maxSlot uint32) []uint32 {
 
 func GetIndexByHash(hashSlotRange []uint32, shardKey []byte, maxSlot uint32) int {
 	slot := crc32.ChecksumIEEE(shardKey) % maxSlot
+	return getIndexBySlot(hashSlotRange, slot)
+}
+
+func getIndexBySlot(hashSlotRange []uint32, slot uint32) int {
 	for i, v := range hashSlotRange {
 		if slot < v {
 			return i
@@ -27,3 +72,202 @@ func GetIndexByHash(hashSlotRange []uint32, shardKey []byte, maxSlot uint32) int
 	}
 	return -1
 }
+
+// --------------------------------
+// CRC32 range
+// --------------------------------
+
+// HashSlotRouter splits the crc32 slots into the even contiguous ranges.
+type HashSlotRouter struct {
+	hashSlot []uint32
+	maxSlot  uint32
+}
+
+// NewHashSlotRouter panics with ShardingConfigError if size is 0 or maxSlot is less than size.
+func NewHashSlotRouter(size int, maxSlot uint32) ShardRouter {
+	if err := ValidateHashSlot(size, maxSlot); err != nil {
+		panic(err)
+	}
+	return &HashSlotRouter{
+		hashSlot: GetHashSlotRange(size, maxSlot),
+		maxSlot:  maxSlot,
+	}
+}
+
+func (r *HashSlotRouter) ShardIndex(shardKey []byte) int {
+	return GetIndexByHash(r.hashSlot, shardKey, r.maxSlot)
+}
+
+// --------------------------------
+// Redis Cluster
+// --------------------------------
+
+const redisClusterSlots = 16384
+
+// RedisClusterRouter uses the same 16384 slots as the Redis Cluster.
+// Only the {hashtag} is hashed if the shard key contains it.
+type RedisClusterRouter struct {
+	hashSlot []uint32
+}
+
+func NewRedisClusterRouter(size int) ShardRouter {
+	return &RedisClusterRouter{
+		hashSlot: GetHashSlotRange(size, redisClusterSlots),
+	}
+}
+
+func (r *RedisClusterRouter) ShardIndex(shardKey []byte) int {
+	return getIndexBySlot(r.hashSlot, RedisClusterSlot(shardKey))
+}
+
+// RedisClusterSlot returns the slot of the key in the Redis Cluster.
+func RedisClusterSlot(key []byte) uint32 {
+	return uint32(crc16(hashTag(key))) % redisClusterSlots
+}
+
+// hashTag returns the content of the first {hashtag}, or the key itself if it is not found or empty.
+func hashTag(key []byte) []byte {
+	for i, c := range key {
+		if c != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					return key[i+1 : j]
+				}
+				break
+			}
+		}
+		break
+	}
+	return key
+}
+
+// crc16 is CRC16-CCITT (XMODEM) used by the Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// --------------------------------
+// Jump consistent hash
+// --------------------------------
+
+// JumpHashRouter uses the jump consistent hash. Only the keys moved to the new shard are remapped when the shard is appended.
+type JumpHashRouter struct {
+	size int
+}
+
+func NewJumpHashRouter(size int) ShardRouter {
+	return &JumpHashRouter{
+		size: size,
+	}
+}
+
+func (r *JumpHashRouter) ShardIndex(shardKey []byte) int {
+	return int(jumpHash(hash64(shardKey), r.size))
+}
+
+func jumpHash(key uint64, size int) int32 {
+	var b, j int64 = -1, 0
+	for j < int64(size) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+func hash64(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64()
+}
+
+// --------------------------------
+// Rendezvous
+// --------------------------------
+
+// RendezvousRouter chooses the shard with the highest score for the key.
+// Only the keys of the removed shard are remapped when the shard is removed.
+type RendezvousRouter struct {
+	size int
+}
+
+func NewRendezvousRouter(size int) ShardRouter {
+	return &RendezvousRouter{
+		size: size,
+	}
+}
+
+func (r *RendezvousRouter) ShardIndex(shardKey []byte) int {
+	index := -1
+	var max uint64
+	// the index is encoded in the fixed length so that the pairs of the index and the key never collide.
+	data := make([]byte, 8+len(shardKey))
+	copy(data[8:], shardKey)
+	for i := 0; i < r.size; i++ {
+		binary.BigEndian.PutUint64(data, uint64(i))
+		score := hash64(data)
+		if index < 0 || score > max {
+			index = i
+			max = score
+		}
+	}
+	return index
+}
+
+// --------------------------------
+// Ketama
+// --------------------------------
+
+type ketamaPoint struct {
+	hash  uint32
+	index int
+}
+
+// KetamaRouter places the virtual nodes of each shard on the hash ring.
+type KetamaRouter struct {
+	ring []ketamaPoint
+}
+
+func NewKetamaRouter(size int, virtualNodes int) ShardRouter {
+	ring := make([]ketamaPoint, 0, size*virtualNodes)
+	for i := 0; i < size; i++ {
+		for v := 0; v < virtualNodes; v++ {
+			node := strconv.Itoa(i) + "-" + strconv.Itoa(v)
+			ring = append(ring, ketamaPoint{hash: crc32.ChecksumIEEE([]byte(node)), index: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &KetamaRouter{
+		ring: ring,
+	}
+}
+
+func (r *KetamaRouter) ShardIndex(shardKey []byte) int {
+	if len(r.ring) == 0 {
+		return -1
+	}
+	hash := crc32.ChecksumIEEE(shardKey)
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= hash
+	})
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].index
+}
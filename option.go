@@ -1,8 +1,18 @@
 package gotx
 
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+)
+
 type Config struct {
-	ReadOnly     bool
-	RollbackOnly bool
+	Name          string
+	ReadOnly      bool
+	RollbackOnly  bool
+	RollbackRules []RollbackRule
+	// the isolation level of the rdbms transaction. it is kept apart from VendorOption used by the other backends.
+	Isolation    sql.IsolationLevel
 	VendorOption interface{}
 }
 
@@ -13,6 +23,20 @@ func NewDefaultConfig() Config {
 	}
 }
 
+// ShouldRollback reports whether the error returned from DoInTransaction rolls back the transaction.
+// The first matched rule is used, and any error rolls back if no rule matches.
+func (c Config) ShouldRollback(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, rule := range c.RollbackRules {
+		if rule.Matcher(err) {
+			return rule.Rollback
+		}
+	}
+	return true
+}
+
 type Option interface {
 	Apply(*Config)
 }
@@ -38,3 +62,60 @@ func (o RollbackOnly) Apply(c *Config) {
 func OptionRollbackOnly() RollbackOnly {
 	return true
 }
+
+// name of the transaction
+type TransactionName string
+
+func (o TransactionName) Apply(c *Config) {
+	c.Name = string(o)
+}
+
+func OptionName(name string) TransactionName {
+	return TransactionName(name)
+}
+
+// ErrorMatcher reports whether the error matches the rollback rule.
+type ErrorMatcher func(err error) bool
+
+// ErrorIs matches the error with errors.Is.
+func ErrorIs(target error) ErrorMatcher {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+// ErrorAs matches the error with errors.As. target is a pointer to the error type like errors.As, e.g. new(*MyError).
+func ErrorAs(target interface{}) ErrorMatcher {
+	typ := reflect.TypeOf(target)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		panic("gotx: target must be a non-nil pointer")
+	}
+	return func(err error) bool {
+		return errors.As(err, reflect.New(typ.Elem()).Interface())
+	}
+}
+
+// rollback rule for the error returned from DoInTransaction
+type RollbackRule struct {
+	Matcher  ErrorMatcher
+	Rollback bool
+}
+
+func (o RollbackRule) Apply(c *Config) {
+	c.RollbackRules = append(c.RollbackRules, o)
+}
+
+// OptionRollbackFor rolls back the transaction if the error matches.
+func OptionRollbackFor(matcher ErrorMatcher) RollbackRule {
+	return RollbackRule{Matcher: matcher, Rollback: true}
+}
+
+// OptionNoRollbackFor commits the transaction if errors.Is(err, target), the error is still returned.
+func OptionNoRollbackFor(target error) RollbackRule {
+	return OptionNoRollbackForFunc(ErrorIs(target))
+}
+
+// OptionNoRollbackForFunc commits the transaction if the error matches, the error is still returned.
+func OptionNoRollbackForFunc(matcher ErrorMatcher) RollbackRule {
+	return RollbackRule{Matcher: matcher, Rollback: false}
+}
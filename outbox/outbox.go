@@ -0,0 +1,75 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/knocknote/gotx"
+)
+
+type Message struct {
+	// Seq is the order of the message assigned by the database. It is 0 if the store orders the messages by CreatedAt.
+	Seq   int64
+	ID    string
+	Topic string
+	// Key is the ordering key. The messages with the same key are published in order.
+	Key       string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// Store persists the messages in the outbox table.
+type Store interface {
+	// Backend is the backend of the transaction which the message is written through.
+	Backend() string
+	// Insert writes the message through the transaction in the context.
+	Insert(ctx context.Context, message *Message) error
+	// FetchPending returns the unsent messages in the order of commit.
+	FetchPending(ctx context.Context, limit int) ([]*Message, error)
+	// MarkSent marks the message as sent.
+	MarkSent(ctx context.Context, id string) error
+}
+
+type Outbox struct {
+	store Store
+}
+
+func New(store Store) *Outbox {
+	return &Outbox{
+		store: store,
+	}
+}
+
+// Enqueue writes the message in the current transaction. The topic is used as the ordering key.
+func (o *Outbox) Enqueue(ctx context.Context, topic string, payload []byte) error {
+	return o.EnqueueWithKey(ctx, topic, topic, payload)
+}
+
+// EnqueueWithKey writes the message in the current transaction.
+// It returns *gotx.IllegalTransactionStateError if no transaction of the backend of the store exists because the message must be written atomically.
+func (o *Outbox) EnqueueWithKey(ctx context.Context, topic string, key string, payload []byte) error {
+	if !gotx.HasTransactionOf(ctx, o.store.Backend()) {
+		return gotx.NewMandatoryError()
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	return o.store.Insert(ctx, &Message{
+		ID:        id,
+		Topic:     topic,
+		Key:       key,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	})
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,143 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gotxrdbms "github.com/knocknote/gotx/rdbms"
+)
+
+// Placeholder returns the bind parameter of the index starting from 1.
+type Placeholder func(index int) string
+
+// DollarPlaceholder is used by PostgreSQL.
+func DollarPlaceholder(index int) string {
+	return fmt.Sprintf("$%d", index)
+}
+
+// QuestionPlaceholder is used by MySQL and SQLite.
+func QuestionPlaceholder(_ int) string {
+	return "?"
+}
+
+type RDBMSStoreConfig struct {
+	// Table is the name of the outbox table. default is outbox.
+	Table string
+	// KeyTable is the name of the table locking the message key. default is Table + "_keys".
+	KeyTable string
+	// Placeholder default is DollarPlaceholder.
+	Placeholder Placeholder
+}
+
+// RDBMSStore uses the following tables. The messages are ordered by seq assigned by the database.
+// Use BIGINT AUTO_INCREMENT UNIQUE for seq in MySQL.
+// Insert locks the row of the key in outbox_keys until the end of the transaction, so the writer of the same key waits for
+// the previous one to complete before its seq is assigned. The seq of the same key follows the commit order.
+// The first messages of a new key written concurrently can fail with the unique violation of outbox_keys, retry the transaction.
+//
+//	CREATE TABLE outbox (
+//	  seq BIGSERIAL NOT NULL UNIQUE,
+//	  id VARCHAR(32) NOT NULL PRIMARY KEY,
+//	  topic VARCHAR(255) NOT NULL,
+//	  message_key VARCHAR(255) NOT NULL,
+//	  payload BYTEA NOT NULL,
+//	  created_at BIGINT NOT NULL,
+//	  sent_at BIGINT
+//	)
+//	CREATE TABLE outbox_keys (
+//	  message_key VARCHAR(255) NOT NULL PRIMARY KEY,
+//	  version BIGINT NOT NULL
+//	)
+type RDBMSStore struct {
+	clientProvider gotxrdbms.ClientProvider
+	table          string
+	keyTable       string
+	placeholder    Placeholder
+}
+
+func NewRDBMSStore(clientProvider gotxrdbms.ClientProvider, config RDBMSStoreConfig) Store {
+	if config.Table == "" {
+		config.Table = "outbox"
+	}
+	if config.KeyTable == "" {
+		config.KeyTable = config.Table + "_keys"
+	}
+	if config.Placeholder == nil {
+		config.Placeholder = DollarPlaceholder
+	}
+	return &RDBMSStore{
+		clientProvider: clientProvider,
+		table:          config.Table,
+		keyTable:       config.KeyTable,
+		placeholder:    config.Placeholder,
+	}
+}
+
+func (s *RDBMSStore) Backend() string {
+	return "rdbms"
+}
+
+func (s *RDBMSStore) Insert(ctx context.Context, message *Message) error {
+	client, err := gotxrdbms.ResolveClient(ctx, s.clientProvider)
+	if err != nil {
+		return err
+	}
+	if err = s.lockKey(ctx, client, message.Key); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, topic, message_key, payload, created_at) VALUES (%s, %s, %s, %s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5))
+	_, err = client.ExecContext(ctx, query,
+		message.ID, message.Topic, message.Key, message.Payload, message.CreatedAt.UnixNano())
+	return err
+}
+
+// lockKey updates the row of the key, which blocks the other writers of the key until the transaction completes.
+func (s *RDBMSStore) lockKey(ctx context.Context, client gotxrdbms.Client, key string) error {
+	query := fmt.Sprintf("UPDATE %s SET version = version + 1 WHERE message_key = %s", s.keyTable, s.placeholder(1))
+	result, err := client.ExecContext(ctx, query, key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	query = fmt.Sprintf("INSERT INTO %s (message_key, version) VALUES (%s, 1)", s.keyTable, s.placeholder(1))
+	_, err = client.ExecContext(ctx, query, key)
+	return err
+}
+
+func (s *RDBMSStore) FetchPending(ctx context.Context, limit int) ([]*Message, error) {
+	query := fmt.Sprintf("SELECT seq, id, topic, message_key, payload, created_at FROM %s WHERE sent_at IS NULL ORDER BY seq LIMIT %d", s.table, limit)
+	client, err := gotxrdbms.ResolveClient(ctx, s.clientProvider)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []*Message
+	for rows.Next() {
+		var message Message
+		var createdAt int64
+		if err = rows.Scan(&message.Seq, &message.ID, &message.Topic, &message.Key, &message.Payload, &createdAt); err != nil {
+			return nil, err
+		}
+		message.CreatedAt = time.Unix(0, createdAt)
+		messages = append(messages, &message)
+	}
+	return messages, rows.Err()
+}
+
+func (s *RDBMSStore) MarkSent(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s SET sent_at = %s WHERE id = %s", s.table, s.placeholder(1), s.placeholder(2))
+	client, err := gotxrdbms.ResolveClient(ctx, s.clientProvider)
+	if err != nil {
+		return err
+	}
+	_, err = client.ExecContext(ctx, query, time.Now().UnixNano(), id)
+	return err
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"context"
+	"time"
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, message *Message) error
+}
+
+type PublisherFunc func(ctx context.Context, message *Message) error
+
+func (f PublisherFunc) Publish(ctx context.Context, message *Message) error {
+	return f(ctx, message)
+}
+
+type RelayConfig struct {
+	// BatchSize is the number of the messages fetched at once. default is 100.
+	BatchSize int
+	// PollInterval is the interval to fetch the messages when the outbox is drained. default is 1s.
+	PollInterval time.Duration
+	// OnError is called when Run fails to relay the messages.
+	OnError func(err error)
+}
+
+// Relay publishes the messages in the outbox and marks them as sent.
+// The message is published at least once, run a single relay for each outbox table to keep the order.
+type Relay struct {
+	store     Store
+	publisher Publisher
+	config    RelayConfig
+}
+
+func NewRelay(store Store, publisher Publisher, config RelayConfig) *Relay {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	return &Relay{
+		store:     store,
+		publisher: publisher,
+		config:    config,
+	}
+}
+
+// Run relays the messages until the context is done.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		sent, err := r.RelayOnce(ctx)
+		if err != nil && r.config.OnError != nil {
+			r.config.OnError(err)
+		}
+		// fetch the next batch immediately if the batch is full.
+		if err == nil && sent == r.config.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.config.PollInterval):
+		}
+	}
+}
+
+// RelayOnce relays a batch of the messages and returns the number of the sent messages.
+// The messages following the failed message with the same key are not published until the next relay.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	messages, err := r.store.FetchPending(ctx, r.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	blocked := map[string]bool{}
+	sent := 0
+	var firstErr error
+	for _, message := range messages {
+		if blocked[message.Key] {
+			continue
+		}
+		if err = r.publisher.Publish(ctx, message); err == nil {
+			err = r.store.MarkSent(ctx, message.ID)
+		}
+		if err != nil {
+			blocked[message.Key] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, firstErr
+}
@@ -0,0 +1,82 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gotxspanner "github.com/knocknote/gotx/spanner"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+)
+
+type SpannerStoreConfig struct {
+	// Table is the name of the outbox table. default is outbox.
+	Table string
+}
+
+// SpannerStore uses the following table. created_at is the commit timestamp.
+//
+//	CREATE TABLE outbox (
+//	  id STRING(32) NOT NULL,
+//	  topic STRING(MAX) NOT NULL,
+//	  message_key STRING(MAX) NOT NULL,
+//	  payload BYTES(MAX) NOT NULL,
+//	  created_at TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true),
+//	  sent_at TIMESTAMP,
+//	) PRIMARY KEY (id)
+type SpannerStore struct {
+	clientProvider gotxspanner.ClientProvider
+	table          string
+}
+
+func NewSpannerStore(clientProvider gotxspanner.ClientProvider, config SpannerStoreConfig) Store {
+	if config.Table == "" {
+		config.Table = "outbox"
+	}
+	return &SpannerStore{
+		clientProvider: clientProvider,
+		table:          config.Table,
+	}
+}
+
+func (s *SpannerStore) Backend() string {
+	return "spanner"
+}
+
+func (s *SpannerStore) Insert(ctx context.Context, message *Message) error {
+	mutation := spanner.Insert(s.table,
+		[]string{"id", "topic", "message_key", "payload", "created_at"},
+		[]interface{}{message.ID, message.Topic, message.Key, message.Payload, spanner.CommitTimestamp})
+	return s.clientProvider.CurrentClient(ctx).ApplyOrBufferWrite(ctx, mutation)
+}
+
+func (s *SpannerStore) FetchPending(ctx context.Context, limit int) ([]*Message, error) {
+	statement := spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT id, topic, message_key, payload, created_at FROM %s WHERE sent_at IS NULL ORDER BY created_at, id LIMIT @limit", s.table),
+		Params: map[string]interface{}{"limit": int64(limit)},
+	}
+	iter := s.clientProvider.CurrentClient(ctx).Reader(ctx).Query(ctx, statement)
+	defer iter.Stop()
+	var messages []*Message
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var message Message
+		if err = row.Columns(&message.ID, &message.Topic, &message.Key, &message.Payload, &message.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, &message)
+	}
+}
+
+func (s *SpannerStore) MarkSent(ctx context.Context, id string) error {
+	mutation := spanner.Update(s.table, []string{"id", "sent_at"}, []interface{}{id, time.Now()})
+	return s.clientProvider.CurrentClient(ctx).ApplyOrBufferWrite(ctx, mutation)
+}
@@ -0,0 +1,417 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationDialect reads the replication position of the primary and the replica.
+type ReplicationDialect interface {
+	// PrimaryPosition returns the position of the primary after the commit.
+	PrimaryPosition(ctx context.Context, primary Conn) (string, error)
+	// HasReplayed reports whether the replica has replayed the position.
+	HasReplayed(ctx context.Context, replica *sql.DB, position string) (bool, error)
+	// LatestPosition returns the position which includes both positions.
+	LatestPosition(a string, b string) (string, error)
+}
+
+// PostgresReplicationDialect uses the WAL LSN.
+type PostgresReplicationDialect struct{}
+
+func (d *PostgresReplicationDialect) PrimaryPosition(ctx context.Context, primary Conn) (string, error) {
+	var lsn string
+	err := primary.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn)
+	return lsn, err
+}
+
+func (d *PostgresReplicationDialect) HasReplayed(ctx context.Context, replica *sql.DB, position string) (bool, error) {
+	var replayed sql.NullBool
+	err := replica.QueryRowContext(ctx, "SELECT pg_last_wal_replay_lsn() >= $1::pg_lsn", position).Scan(&replayed)
+	return replayed.Bool, err
+}
+
+func (d *PostgresReplicationDialect) LatestPosition(a string, b string) (string, error) {
+	lsnA, err := parseLSN(a)
+	if err != nil {
+		return "", err
+	}
+	lsnB, err := parseLSN(b)
+	if err != nil {
+		return "", err
+	}
+	if lsnA >= lsnB {
+		return a, nil
+	}
+	return b, nil
+}
+
+// parseLSN parses the text form of pg_lsn such as 16/B374D848.
+func parseLSN(position string) (uint64, error) {
+	parts := strings.Split(position, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid lsn %q", position)
+	}
+	high, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	low, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return high<<32 | low, nil
+}
+
+// MySQLReplicationDialect uses the GTID.
+type MySQLReplicationDialect struct{}
+
+func (d *MySQLReplicationDialect) PrimaryPosition(ctx context.Context, primary Conn) (string, error) {
+	var gtid string
+	err := primary.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&gtid)
+	return gtid, err
+}
+
+func (d *MySQLReplicationDialect) HasReplayed(ctx context.Context, replica *sql.DB, position string) (bool, error) {
+	var replayed bool
+	err := replica.QueryRowContext(ctx, "SELECT GTID_SUBSET(?, @@GLOBAL.gtid_executed)", position).Scan(&replayed)
+	return replayed, err
+}
+
+// LatestPosition returns the union of the gtid sets.
+func (d *MySQLReplicationDialect) LatestPosition(a string, b string) (string, error) {
+	set := map[string][]gtidInterval{}
+	for _, position := range []string{a, b} {
+		if err := parseGTIDSet(position, set); err != nil {
+			return "", err
+		}
+	}
+	sources := make([]string, 0, len(set))
+	for source := range set {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	parts := make([]string, 0, len(sources))
+	for _, source := range sources {
+		var part strings.Builder
+		part.WriteString(source)
+		for _, interval := range mergeIntervals(set[source]) {
+			if interval.start == interval.end {
+				part.WriteString(fmt.Sprintf(":%d", interval.start))
+			} else {
+				part.WriteString(fmt.Sprintf(":%d-%d", interval.start, interval.end))
+			}
+		}
+		parts = append(parts, part.String())
+	}
+	return strings.Join(parts, ","), nil
+}
+
+type gtidInterval struct {
+	start uint64
+	end   uint64
+}
+
+// parseGTIDSet adds the intervals of each uuid (and tag) such as 3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:7.
+func parseGTIDSet(position string, set map[string][]gtidInterval) error {
+	for _, text := range strings.Split(position, ",") {
+		fields := strings.Split(strings.TrimSpace(text), ":")
+		if fields[0] == "" {
+			continue
+		}
+		source := fields[0]
+		for _, field := range fields[1:] {
+			bounds := strings.SplitN(field, "-", 2)
+			start, err := strconv.ParseUint(bounds[0], 10, 64)
+			if err != nil {
+				// the tag of the following intervals.
+				source = fields[0] + ":" + field
+				continue
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.ParseUint(bounds[1], 10, 64); err != nil {
+					return fmt.Errorf("invalid gtid set %q", position)
+				}
+			}
+			set[source] = append(set[source], gtidInterval{start: start, end: end})
+		}
+	}
+	return nil
+}
+
+func mergeIntervals(intervals []gtidInterval) []gtidInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start < intervals[j].start
+	})
+	var merged []gtidInterval
+	for _, interval := range intervals {
+		last := len(merged) - 1
+		if last >= 0 && interval.start <= merged[last].end+1 {
+			if interval.end > merged[last].end {
+				merged[last].end = interval.end
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// ------------------------------------
+// Session
+// ------------------------------------
+
+// SessionToken is the position of the primary at the last commit of the session.
+type SessionToken struct {
+	Position string `json:"p"`
+}
+
+// String encodes the token to travel in the cookie or the header.
+func (t SessionToken) String() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ParseSessionToken(value string) (SessionToken, error) {
+	var token SessionToken
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(data, &token)
+	return token, err
+}
+
+type sessionTokenKey struct{}
+
+// WithSessionToken sets the token received from the client. The later position of it and the token in the SessionStore is used.
+func WithSessionToken(ctx context.Context, token SessionToken) context.Context {
+	return context.WithValue(ctx, sessionTokenKey{}, token)
+}
+
+// SessionStore remembers the token of each session key.
+type SessionStore interface {
+	Get(ctx context.Context, sessionKey string) (SessionToken, bool)
+	Set(ctx context.Context, sessionKey string, token SessionToken)
+}
+
+type memorySessionEntry struct {
+	token   SessionToken
+	expires time.Time
+}
+
+type memorySessionStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]memorySessionEntry
+	// the expired entries are swept when the entries grow to this size.
+	sweepAt int
+}
+
+// minSweepSize is the size of the map swept first. The size is doubled after each sweep, so the sweep costs O(1) per write.
+const minSweepSize = 1024
+
+func nextSweepSize(size int) int {
+	if size*2 < minSweepSize {
+		return minSweepSize
+	}
+	return size * 2
+}
+
+// NewMemorySessionStore forgets the token after ttl. The replicas are expected to catch up within ttl.
+func NewMemorySessionStore(ttl time.Duration) SessionStore {
+	return &memorySessionStore{
+		ttl:     ttl,
+		entries: map[string]memorySessionEntry{},
+		sweepAt: minSweepSize,
+	}
+}
+
+func (s *memorySessionStore) Get(_ context.Context, sessionKey string) (SessionToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[sessionKey]
+	if !ok {
+		return SessionToken{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.entries, sessionKey)
+		return SessionToken{}, false
+	}
+	return entry.token, true
+}
+
+func (s *memorySessionStore) Set(_ context.Context, sessionKey string, token SessionToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.entries) >= s.sweepAt {
+		for key, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.sweepAt = nextSweepSize(len(s.entries))
+	}
+	s.entries[sessionKey] = memorySessionEntry{token: token, expires: now.Add(s.ttl)}
+}
+
+// ConsistencyConfig enables the read-your-writes consistency of the ReplicaAwareConnectionProvider.
+type ConsistencyConfig struct {
+	Dialect ReplicationDialect
+	// SessionKeyProvider returns the key of the session such as the user id. The token is not remembered if it returns empty.
+	// default remembers no token, so only the token set by WithSessionToken is used.
+	SessionKeyProvider func(ctx context.Context) string
+	// default is the memory store with 1 minute ttl.
+	Store SessionStore
+	// ReplayCheckTTL is the duration to reuse the result of HasReplayed of each replica and position. default is 1s.
+	ReplayCheckTTL time.Duration
+}
+
+var defaultSessionKeyProvider = func(ctx context.Context) string {
+	return ""
+}
+
+// withDefaults returns the copy of the config with the default values.
+func (c ConsistencyConfig) withDefaults() *ConsistencyConfig {
+	if c.SessionKeyProvider == nil {
+		c.SessionKeyProvider = defaultSessionKeyProvider
+	}
+	if c.Store == nil {
+		c.Store = NewMemorySessionStore(time.Minute)
+	}
+	if c.ReplayCheckTTL <= 0 {
+		c.ReplayCheckTTL = time.Second
+	}
+	return &c
+}
+
+// SessionToken returns the token of the current session to send it to the client.
+// It is the later position of the token set by WithSessionToken and the token in the SessionStore.
+func (p *ReplicaAwareConnectionProvider) SessionToken(ctx context.Context) (SessionToken, bool) {
+	received, hasReceived := ctx.Value(sessionTokenKey{}).(SessionToken)
+	if p.consistency == nil {
+		return received, hasReceived
+	}
+	var stored SessionToken
+	hasStored := false
+	if sessionKey := p.consistency.SessionKeyProvider(ctx); sessionKey != "" {
+		stored, hasStored = p.consistency.Store.Get(ctx, sessionKey)
+	}
+	if !hasStored {
+		return received, hasReceived
+	}
+	if !hasReceived {
+		return stored, true
+	}
+	// the empty position reads the primary, which is the latest.
+	if received.Position == "" || stored.Position == "" {
+		return SessionToken{}, true
+	}
+	position, err := p.consistency.Dialect.LatestPosition(received.Position, stored.Position)
+	if err != nil {
+		return SessionToken{}, true
+	}
+	return SessionToken{Position: position}, true
+}
+
+// OnCommit remembers the position of the primary for the session.
+func (p *ReplicaAwareConnectionProvider) OnCommit(ctx context.Context, conn Conn) {
+	if p.consistency == nil || conn != Conn(p.primary) {
+		return
+	}
+	sessionKey := p.consistency.SessionKeyProvider(ctx)
+	if sessionKey == "" {
+		return
+	}
+	position, err := p.consistency.Dialect.PrimaryPosition(ctx, p.primary)
+	if err != nil {
+		// the reads of the session use the primary until the replicas catch up with the current position.
+		p.consistency.Store.Set(ctx, sessionKey, SessionToken{})
+		return
+	}
+	p.consistency.Store.Set(ctx, sessionKey, SessionToken{Position: position})
+}
+
+// caughtUp returns the replicas which replayed the last commit of the session.
+// The token set by WithSessionToken is ignored without the consistency because the replay can not be checked.
+func (p *ReplicaAwareConnectionProvider) caughtUp(ctx context.Context, replicas []*sql.DB) []*sql.DB {
+	if p.consistency == nil {
+		return replicas
+	}
+	token, ok := p.SessionToken(ctx)
+	if !ok {
+		return replicas
+	}
+	if token.Position == "" {
+		return nil
+	}
+	caughtUp := make([]*sql.DB, 0, len(replicas))
+	for _, replica := range replicas {
+		if p.replays.hasReplayed(ctx, p.consistency.Dialect, replica, token.Position) {
+			caughtUp = append(caughtUp, replica)
+		}
+	}
+	return caughtUp
+}
+
+type replayKey struct {
+	replica  *sql.DB
+	position string
+}
+
+type replayEntry struct {
+	replayed bool
+	expires  time.Time
+}
+
+// replayCache reuses the result of HasReplayed so that the reads do not query every replica each time.
+type replayCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[replayKey]replayEntry
+	// the expired entries are swept when the entries grow to this size.
+	sweepAt int
+}
+
+func newReplayCache(ttl time.Duration) *replayCache {
+	return &replayCache{
+		ttl:     ttl,
+		entries: map[replayKey]replayEntry{},
+		sweepAt: minSweepSize,
+	}
+}
+
+func (c *replayCache) hasReplayed(ctx context.Context, dialect ReplicationDialect, replica *sql.DB, position string) bool {
+	key := replayKey{replica: replica, position: position}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.replayed
+	}
+	replayed, err := dialect.HasReplayed(ctx, replica, position)
+	replayed = err == nil && replayed
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.sweepAt {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.sweepAt = nextSweepSize(len(c.entries))
+	}
+	c.entries[key] = replayEntry{replayed: replayed, expires: now.Add(c.ttl)}
+	return replayed
+}
@@ -0,0 +1,154 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/knocknote/gotx"
+)
+
+// MigratingConnectionProvider routes the shard key by the MigratingShardRouter during the online resharding.
+// Use it with the ScopedTransactor or the XATransactor to write both shards in the same transaction scope.
+type MigratingConnectionProvider struct {
+	db               []*sql.DB
+	router           *gotx.MigratingShardRouter
+	shardKeyProvider ShardKeyProvider
+}
+
+// db is the connections of all the shards in the new slot map.
+// It panics with ShardingConfigError if the slot maps use more shards than db.
+func NewMigratingConnectionProvider(db []*sql.DB, router *gotx.MigratingShardRouter, shardKeyProvider ShardKeyProvider) *MigratingConnectionProvider {
+	if len(db) == 0 || router == nil {
+		panic(&gotx.ShardingConfigError{Reason: "connections and router are required"})
+	}
+	if router.Size() > len(db) {
+		panic(&gotx.ShardingConfigError{Reason: fmt.Sprintf("slot maps use %d shards for %d connections", router.Size(), len(db))})
+	}
+	return &MigratingConnectionProvider{
+		db:               db,
+		router:           router,
+		shardKeyProvider: shardKeyProvider,
+	}
+}
+
+// CurrentConnection returns the connection of the new shard.
+func (p *MigratingConnectionProvider) CurrentConnection(ctx context.Context) Conn {
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (p *MigratingConnectionProvider) ResolveConnection(ctx context.Context) (Conn, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	index := p.router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(p.db) {
+		return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: index, Size: len(p.db)}
+	}
+	return p.db[index], nil
+}
+
+// WriteConnections returns the connections of the new shard and the old shard if the slot is migrating.
+func (p *MigratingConnectionProvider) WriteConnections(ctx context.Context) ([]Conn, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return p.connections(shardKey, p.router.WriteShards([]byte(shardKey)))
+}
+
+// ReadConnections returns the connections in the order of the fallback.
+func (p *MigratingConnectionProvider) ReadConnections(ctx context.Context) ([]Conn, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return p.connections(shardKey, p.router.ReadShards([]byte(shardKey)))
+}
+
+func (p *MigratingConnectionProvider) connections(shardKey string, shards []int) ([]Conn, error) {
+	connections := make([]Conn, len(shards))
+	for i, shard := range shards {
+		if shard < 0 || shard >= len(p.db) {
+			return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: shard, Size: len(p.db)}
+		}
+		connections[i] = p.db[shard]
+	}
+	return connections, nil
+}
+
+// Switch completes the migration at runtime.
+func (p *MigratingConnectionProvider) Switch() {
+	p.router.Switch()
+}
+
+// MigratingClientProvider returns the clients in the transaction scope of the MigratingConnectionProvider.
+type MigratingClientProvider struct {
+	connectionProvider *MigratingConnectionProvider
+}
+
+func NewMigratingClientProvider(connectionProvider *MigratingConnectionProvider) *MigratingClientProvider {
+	return &MigratingClientProvider{
+		connectionProvider: connectionProvider,
+	}
+}
+
+// CurrentClient returns the client of the new shard. It panics if the shard can not be determined. Use ResolveClient to get the error.
+func (p *MigratingClientProvider) CurrentClient(ctx context.Context) Client {
+	client, err := p.ResolveClient(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// ResolveClient returns the client of the new shard.
+func (p *MigratingClientProvider) ResolveClient(ctx context.Context) (Client, error) {
+	conn, err := p.connectionProvider.ResolveConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.client(ctx, conn)
+}
+
+// WriteClients returns the clients to write both the new shard and the old shard.
+func (p *MigratingClientProvider) WriteClients(ctx context.Context) ([]Client, error) {
+	conns, err := p.connectionProvider.WriteConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.clients(ctx, conns)
+}
+
+// ReadClients returns the clients in the order of the fallback.
+func (p *MigratingClientProvider) ReadClients(ctx context.Context) ([]Client, error) {
+	conns, err := p.connectionProvider.ReadConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.clients(ctx, conns)
+}
+
+func (p *MigratingClientProvider) clients(ctx context.Context, conns []Conn) ([]Client, error) {
+	clients := make([]Client, len(conns))
+	for i, conn := range conns {
+		client, err := p.client(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		clients[i] = client
+	}
+	return clients, nil
+}
+
+func (p *MigratingClientProvider) client(ctx context.Context, conn Conn) (Client, error) {
+	if scope := currentShardScope(ctx, p.connectionProvider); scope != nil {
+		return scope.client(conn)
+	}
+	return conn, nil
+}
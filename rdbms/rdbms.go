@@ -3,7 +3,11 @@ package gotx
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/knocknote/gotx"
 )
@@ -18,6 +22,15 @@ func contextKey(shardKey string) contextTransactionKey {
 	return contextTransactionKey(fmt.Sprintf("current_%s_tx", shardKey))
 }
 
+// transactionKey returns the error instead of the panic if the shard key can not be determined.
+func transactionKey(ctx context.Context, shardKeyProvider ShardKeyProvider) (contextTransactionKey, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, shardKeyProvider)
+	if err != nil {
+		return "", err
+	}
+	return contextKey(shardKey), nil
+}
+
 // --------------------------------
 // Connection
 // --------------------------------
@@ -25,6 +38,19 @@ type ConnectionProvider interface {
 	CurrentConnection(ctx context.Context) Conn
 }
 
+// ConnectionResolver is implemented by the ConnectionProvider which can fail to determine the connection.
+type ConnectionResolver interface {
+	ResolveConnection(ctx context.Context) (Conn, error)
+}
+
+// ResolveConnection returns the error instead of the panic if the provider implements ConnectionResolver.
+func ResolveConnection(ctx context.Context, provider ConnectionProvider) (Conn, error) {
+	if resolver, ok := provider.(ConnectionResolver); ok {
+		return resolver.ResolveConnection(ctx)
+	}
+	return provider.CurrentConnection(ctx), nil
+}
+
 // get db connection from field
 type DefaultConnectionProvider struct {
 	db Conn
@@ -42,27 +68,154 @@ func (p *DefaultConnectionProvider) CurrentConnection(_ context.Context) Conn {
 
 type ShardKeyProvider func(ctx context.Context) string
 
+// Topology is the connections and the router of the sharding.
+type Topology struct {
+	DB []*sql.DB
+	// the router must return the index of DB.
+	Router gotx.ShardRouter
+}
+
 // get db by hash slot
 type ShardingConnectionProvider struct {
-	db               []*sql.DB
-	hashSlot         []uint32
+	mu               sync.Mutex
+	topology         atomic.Value
 	shardKeyProvider ShardKeyProvider
-	maxSlot          uint32
+	onReload         gotx.ReloadHook
 }
 
+// NewShardingConnectionProvider panics with ShardingConfigError if db is empty or maxSlot is less than the number of db.
 func NewShardingConnectionProvider(db []*sql.DB, maxSlot uint32, shardKeyProvider ShardKeyProvider) ConnectionProvider {
-	return &ShardingConnectionProvider{
-		db:               db,
+	if err := gotx.ValidateHashSlot(len(db), maxSlot); err != nil {
+		panic(err)
+	}
+	return NewShardingConnectionProviderWithRouter(db, gotx.NewHashSlotRouter(len(db), maxSlot), shardKeyProvider)
+}
+
+// the router must return the index of db.
+func NewShardingConnectionProviderWithRouter(db []*sql.DB, router gotx.ShardRouter, shardKeyProvider ShardKeyProvider) ConnectionProvider {
+	if len(db) == 0 || router == nil {
+		panic(&gotx.ShardingConfigError{Reason: "connections and router are required"})
+	}
+	p := &ShardingConnectionProvider{
 		shardKeyProvider: shardKeyProvider,
-		hashSlot:         gotx.GetHashSlotRange(len(db), maxSlot),
-		maxSlot:          maxSlot,
 	}
+	p.topology.Store(&Topology{DB: db, Router: router})
+	return p
+}
+
+// NewShardingConnectionProviderWithSlotMap returns error if the slot map is invalid or the number of the shards is not the same as db.
+func NewShardingConnectionProviderWithSlotMap(db []*sql.DB, slotMap *gotx.SlotMap, shardKeyProvider ShardKeyProvider) (ConnectionProvider, error) {
+	if slotMap.Size() != len(db) {
+		return nil, &gotx.SlotMapError{Reason: fmt.Sprintf("%d shards are listed for %d connections", slotMap.Size(), len(db))}
+	}
+	router, err := slotMap.Router()
+	if err != nil {
+		return nil, err
+	}
+	return NewShardingConnectionProviderWithRouter(db, router, shardKeyProvider), nil
 }
 
+// CurrentConnection panics if the shard can not be determined. Use ResolveConnection to get the error.
 func (p *ShardingConnectionProvider) CurrentConnection(ctx context.Context) Conn {
-	shardKey := p.shardKeyProvider(ctx)
-	index := gotx.GetIndexByHash(p.hashSlot, []byte(shardKey), p.maxSlot)
-	return p.db[index]
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (p *ShardingConnectionProvider) ResolveConnection(ctx context.Context) (Conn, error) {
+	topology := p.topology.Load().(*Topology)
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	index := topology.Router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(topology.DB) {
+		return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: index, Size: len(topology.DB)}
+	}
+	return topology.DB[index], nil
+}
+
+// OnReload sets the hook called when the reload completes.
+func (p *ShardingConnectionProvider) OnReload(hook gotx.ReloadHook) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onReload = hook
+}
+
+// Reload swaps the topology atomically. The transactions already begun keep using the original connection.
+// The connections removed from the topology are closed after all of them are released or the context is done.
+func (p *ShardingConnectionProvider) Reload(ctx context.Context, topology Topology) error {
+	if len(topology.DB) == 0 || topology.Router == nil {
+		return errors.New("connections and router are required for the topology")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := time.Now()
+	current := p.topology.Load().(*Topology)
+	p.topology.Store(&topology)
+
+	event := gotx.ReloadEvent{}
+	for _, db := range topology.DB {
+		if !containsConnection(current.DB, db) {
+			event.Added++
+		}
+	}
+	for _, db := range current.DB {
+		if containsConnection(topology.DB, db) {
+			continue
+		}
+		event.Removed++
+		if err := drain(ctx, db); err != nil && event.Err == nil {
+			event.Err = err
+		}
+	}
+	event.Elapsed = time.Since(start)
+	if p.onReload != nil {
+		p.onReload(event)
+	}
+	return event.Err
+}
+
+var drainInterval = 10 * time.Millisecond
+
+// drain waits for the connections in use to be released and closes the db.
+func drain(ctx context.Context, db *sql.DB) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil && db.Stats().InUse > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func containsConnection(dbs []*sql.DB, target *sql.DB) bool {
+	for _, db := range dbs {
+		if db == target {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitListener is implemented by the ConnectionProvider which is notified of the commit of the read-write transaction.
+type CommitListener interface {
+	OnCommit(ctx context.Context, conn Conn)
+}
+
+func notifyCommit(ctx context.Context, provider ConnectionProvider, conn Conn) {
+	if listener, ok := provider.(CommitListener); ok {
+		listener.OnCommit(ctx, conn)
+	}
 }
 
 // ------------------------------------
@@ -87,6 +240,19 @@ type ClientProvider interface {
 	CurrentClient(ctx context.Context) Client
 }
 
+// ClientResolver is implemented by the ClientProvider which can fail to determine the client.
+type ClientResolver interface {
+	ResolveClient(ctx context.Context) (Client, error)
+}
+
+// ResolveClient returns the error instead of the panic if the provider implements ClientResolver.
+func ResolveClient(ctx context.Context, provider ClientProvider) (Client, error) {
+	if resolver, ok := provider.(ClientResolver); ok {
+		return resolver.ResolveClient(ctx)
+	}
+	return provider.CurrentClient(ctx), nil
+}
+
 type DefaultClientProvider struct {
 	shardKeyProvider   ShardKeyProvider
 	connectionProvider ConnectionProvider
@@ -103,67 +269,299 @@ func NewShardingDefaultClientProvider(connectionProvider ConnectionProvider, sha
 	}
 }
 
+// CurrentClient panics if the shard can not be determined. Use ResolveClient to get the error.
 func (p *DefaultClientProvider) CurrentClient(ctx context.Context) Client {
-	key := contextKey(p.shardKeyProvider(ctx))
-	transaction := ctx.Value(key)
-	if transaction == nil {
-		return p.connectionProvider.CurrentConnection(ctx)
+	client, err := p.ResolveClient(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// ResolveClient returns ShardKeyNotFoundError or ShardRoutingError if the shard can not be determined,
+// or the error to begin the transaction of the shard in the scope of the ScopedTransactor.
+func (p *DefaultClientProvider) ResolveClient(ctx context.Context) (Client, error) {
+	if scope := currentShardScope(ctx, p.connectionProvider); scope != nil {
+		conn, err := ResolveConnection(ctx, p.connectionProvider)
+		if err != nil {
+			return nil, err
+		}
+		return scope.client(conn)
+	}
+	key, err := transactionKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
 	}
-	return transaction.(Client)
+	current := ctx.Value(key)
+	if current == nil {
+		return ResolveConnection(ctx, p.connectionProvider)
+	}
+	return current.(*transaction).Tx, nil
 }
 
 // ------------------------------------
 // Transactor
 // ------------------------------------
+
+// isolation level of the transaction
+type Isolation sql.IsolationLevel
+
+func (o Isolation) Apply(c *gotx.Config) {
+	c.Isolation = sql.IsolationLevel(o)
+}
+
+func OptionIsolation(level sql.IsolationLevel) Isolation {
+	return Isolation(level)
+}
+
+// IsolationLevelError is returned when the joined transaction is less strict than the requested isolation level.
+type IsolationLevelError struct {
+	Requested sql.IsolationLevel
+	Current   sql.IsolationLevel
+}
+
+func (e *IsolationLevelError) Error() string {
+	return fmt.Sprintf("isolation level %s is requested but the current transaction is %s", e.Requested, e.Current)
+}
+
+func isolationLevel(config gotx.Config) sql.IsolationLevel {
+	return config.Isolation
+}
+
+func newConfig(options []gotx.Option) gotx.Config {
+	config := gotx.NewDefaultConfig()
+	for _, opt := range options {
+		opt.Apply(&config)
+	}
+	return config
+}
+
+// transaction stored in the context. depth is incremented by each nested transaction.
+type transaction struct {
+	*sql.Tx
+	conn      Conn
+	depth     int
+	isolation sql.IsolationLevel
+	status    *gotx.DefaultTransactionStatus
+}
+
 type Transactor struct {
 	shardKeyProvider   ShardKeyProvider
 	connectionProvider ConnectionProvider
+	savepointDialect   SavepointDialect
+}
+
+type TransactorConfig struct {
+	// SavepointDialect enables the nested transaction. Nested returns error in the current transaction if it is nil.
+	SavepointDialect SavepointDialect
 }
 
 func NewTransactor(connectionProvider ConnectionProvider) gotx.Transactor {
 	return NewShardingTransactor(connectionProvider, defaultShardKeyProvider)
 }
 
+func NewTransactorWithConfig(connectionProvider ConnectionProvider, config TransactorConfig) gotx.Transactor {
+	return NewShardingTransactorWithConfig(connectionProvider, defaultShardKeyProvider, config)
+}
+
 func NewShardingTransactor(connectionProvider ConnectionProvider, shardKeyProvider ShardKeyProvider) gotx.Transactor {
+	return NewShardingTransactorWithConfig(connectionProvider, shardKeyProvider, TransactorConfig{})
+}
+
+func NewShardingTransactorWithConfig(connectionProvider ConnectionProvider, shardKeyProvider ShardKeyProvider, config TransactorConfig) gotx.Transactor {
 	return &Transactor{
 		shardKeyProvider:   shardKeyProvider,
 		connectionProvider: connectionProvider,
+		savepointDialect:   config.SavepointDialect,
 	}
 }
 
 func (t *Transactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
-	if ctx.Value(contextKey(t.shardKeyProvider(ctx))) != nil {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	current := ctx.Value(key)
+	if current == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	requested := isolationLevel(newConfig(options))
+	tx := current.(*transaction)
+	if requested != sql.LevelDefault && requested > tx.isolation {
+		return &IsolationLevelError{Requested: requested, Current: tx.isolation}
+	}
+	return fn(gotx.WithStatus(ctx, tx.status.Join()))
+}
+
+func (t *Transactor) Supports(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	current, err := t.currentTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	ctx = readOnlyContext(ctx, options)
+	if current == nil {
 		return fn(ctx)
 	}
-	return t.RequiresNew(ctx, fn, options...)
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *Transactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current, err := t.currentTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return gotx.NewMandatoryError()
+	}
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *Transactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	exists, err := t.hasTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return gotx.NewNeverError()
+	}
+	return fn(ctx)
+}
+
+func (t *Transactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	// the client provider returns the connection if the transaction is nil.
+	ctx = withShardScope(context.WithValue(ctx, key, nil), t.connectionProvider, nil)
+	return fn(gotx.WithStatus(readOnlyContext(ctx, options), nil))
+}
+
+// readOnlyContext routes the reads without the transaction to the replica if OptionReadOnly is set.
+func readOnlyContext(ctx context.Context, options []gotx.Option) context.Context {
+	if !newConfig(options).ReadOnly {
+		return ctx
+	}
+	return WithReadOnly(ctx)
+}
+
+func (t *Transactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) (err error) {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	current := ctx.Value(key)
+	if current == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	if t.savepointDialect == nil {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "rdbms"}
+	}
+	config := newConfig(options)
+	parent := current.(*transaction)
+	nested := &transaction{
+		Tx:        parent.Tx,
+		depth:     parent.depth + 1,
+		isolation: parent.isolation,
+		status:    parent.status.Nest(config),
+	}
+	name := savepointName(nested.depth)
+	if _, err = nested.ExecContext(ctx, t.savepointDialect.CreateSavepoint(name)); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = t.rollbackToSavepoint(ctx, nested.Tx, name)
+			panic(p)
+		} else if config.ShouldRollback(err) || nested.status.IsRollbackOnly() {
+			if rollbackErr := t.rollbackToSavepoint(ctx, nested.Tx, name); rollbackErr != nil && err == nil {
+				err = rollbackErr
+			}
+		} else if _, releaseErr := nested.ExecContext(ctx, t.savepointDialect.ReleaseSavepoint(name)); releaseErr != nil {
+			err = releaseErr
+		}
+	}()
+	err = fn(gotx.WithStatus(context.WithValue(ctx, key, nested), nested.status))
+	return
+}
+
+func (t *Transactor) rollbackToSavepoint(ctx context.Context, tx *sql.Tx, name string) error {
+	if _, err := tx.ExecContext(ctx, t.savepointDialect.RollbackToSavepoint(name)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, t.savepointDialect.ReleaseSavepoint(name))
+	return err
+}
+
+func (t *Transactor) hasTransaction(ctx context.Context) (bool, error) {
+	current, err := t.currentTransaction(ctx)
+	return current != nil, err
+}
+
+func (t *Transactor) currentTransaction(ctx context.Context) (*transaction, error) {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := ctx.Value(key).(*transaction)
+	return current, nil
 }
 
 func (t *Transactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) (err error) {
-	config := gotx.NewDefaultConfig()
-	for _, opt := range options {
-		opt.Apply(&config)
+	config := newConfig(options)
+	isolation := isolationLevel(config)
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	// the read-only transaction begins on the replica.
+	db, err := ResolveConnection(withReadOnly(ctx, config.ReadOnly), t.connectionProvider)
+	if err != nil {
+		return err
 	}
-	db := t.connectionProvider.CurrentConnection(ctx)
 	tx, err := db.BeginTx(ctx, &sql.TxOptions{
-		ReadOnly: config.ReadOnly,
+		Isolation: isolation,
+		ReadOnly:  config.ReadOnly,
 	})
 	if err != nil {
 		return err
 	}
+	status := gotx.NewTransactionStatus("rdbms", true, config)
+	current := &transaction{Tx: tx, conn: db, isolation: isolation, status: status}
+	// the new transaction suspends the shard scope of the same connection provider.
+	txCtx := withShardScope(context.WithValue(ctx, key, current), t.connectionProvider, nil)
+	txCtx = gotx.WithStatus(txCtx, status)
 	defer func() {
 		if p := recover(); p != nil {
 			_ = tx.Rollback()
+			status.TriggerAfterRollback(ctx)
 			panic(p)
-		} else if err != nil {
-			_ = tx.Rollback()
-		} else {
-			if config.RollbackOnly {
-				_ = tx.Rollback()
-			} else {
-				err = tx.Commit()
-			}
 		}
+		err = t.complete(ctx, txCtx, current, config, err)
 	}()
-	err = fn(context.WithValue(ctx, contextKey(t.shardKeyProvider(ctx)), tx))
+	err = fn(txCtx)
 	return
 }
+
+func (t *Transactor) complete(ctx context.Context, txCtx context.Context, current *transaction, config gotx.Config, err error) error {
+	if config.ShouldRollback(err) || current.status.IsRollbackOnly() {
+		_ = current.Rollback()
+		current.status.TriggerAfterRollback(ctx)
+		return err
+	}
+	if syncErr := current.status.TriggerBeforeCommit(txCtx); syncErr != nil {
+		_ = current.Rollback()
+		current.status.TriggerAfterRollback(ctx)
+		return syncErr
+	}
+	if commitErr := current.Commit(); commitErr != nil {
+		current.status.TriggerAfterRollback(ctx)
+		return commitErr
+	}
+	if !config.ReadOnly {
+		notifyCommit(ctx, t.connectionProvider, current.conn)
+	}
+	current.status.TriggerAfterCommit(ctx)
+	// the error matched with the no rollback rule is returned after commit.
+	return err
+}
@@ -0,0 +1,255 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/knocknote/gotx"
+)
+
+type readOnlyKey struct{}
+
+// WithReadOnly routes the connection to the replica by the ReplicaAwareConnectionProvider.
+// The read-only transaction and NotSupported / Supports with OptionReadOnly set it automatically.
+func WithReadOnly(ctx context.Context) context.Context {
+	return withReadOnly(ctx, true)
+}
+
+func withReadOnly(ctx context.Context, readOnly bool) context.Context {
+	if !readOnly && !IsReadOnly(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, readOnlyKey{}, readOnly)
+}
+
+func IsReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
+
+// ------------------------------------
+// Balancer
+// ------------------------------------
+
+// ReplicaBalancer chooses the replica from the healthy replicas.
+type ReplicaBalancer interface {
+	Choose(replicas []*sql.DB) *sql.DB
+}
+
+type roundRobinBalancer struct {
+	counter uint64
+}
+
+func NewRoundRobinBalancer() ReplicaBalancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Choose(replicas []*sql.DB) *sql.DB {
+	n := atomic.AddUint64(&b.counter, 1)
+	return replicas[(n-1)%uint64(len(replicas))]
+}
+
+type leastConnectionsBalancer struct{}
+
+// NewLeastConnectionsBalancer chooses the replica with the fewest connections in use.
+func NewLeastConnectionsBalancer() ReplicaBalancer {
+	return &leastConnectionsBalancer{}
+}
+
+func (b *leastConnectionsBalancer) Choose(replicas []*sql.DB) *sql.DB {
+	chosen := replicas[0]
+	least := chosen.Stats().InUse
+	for _, replica := range replicas[1:] {
+		if inUse := replica.Stats().InUse; inUse < least {
+			chosen = replica
+			least = inUse
+		}
+	}
+	return chosen
+}
+
+// ------------------------------------
+// Provider
+// ------------------------------------
+
+type ReplicaConfig struct {
+	// default is round robin.
+	Balancer ReplicaBalancer
+	// HealthCheck returns error if the replica must not be used. default is ping.
+	HealthCheck func(ctx context.Context, replica *sql.DB) error
+	// interval of RunHealthCheck. default is 5s.
+	HealthCheckInterval time.Duration
+	// Consistency routes the reads of the session only to the replicas which replayed the last commit of the session.
+	Consistency *ConsistencyConfig
+}
+
+type replica struct {
+	db        *sql.DB
+	unhealthy int32
+}
+
+// ReplicaAwareConnectionProvider returns the replica for the read-only transaction and the reads marked by WithReadOnly.
+// The writes and the read-write transaction use the primary. The primary is used for the reads if no replicas are healthy,
+// or no replicas have caught up with the session when the consistency is enabled.
+type ReplicaAwareConnectionProvider struct {
+	primary             *sql.DB
+	replicas            []*replica
+	balancer            ReplicaBalancer
+	healthCheck         func(ctx context.Context, replica *sql.DB) error
+	healthCheckInterval time.Duration
+	consistency         *ConsistencyConfig
+	replays             *replayCache
+}
+
+func NewReplicaAwareConnectionProvider(primary *sql.DB, replicas []*sql.DB, config ReplicaConfig) *ReplicaAwareConnectionProvider {
+	if config.Balancer == nil {
+		config.Balancer = NewRoundRobinBalancer()
+	}
+	if config.HealthCheck == nil {
+		config.HealthCheck = func(ctx context.Context, replica *sql.DB) error {
+			return replica.PingContext(ctx)
+		}
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = 5 * time.Second
+	}
+	p := &ReplicaAwareConnectionProvider{
+		primary:             primary,
+		balancer:            config.Balancer,
+		healthCheck:         config.HealthCheck,
+		healthCheckInterval: config.HealthCheckInterval,
+	}
+	if config.Consistency != nil {
+		p.consistency = config.Consistency.withDefaults()
+		p.replays = newReplayCache(p.consistency.ReplayCheckTTL)
+	}
+	for _, db := range replicas {
+		p.replicas = append(p.replicas, &replica{db: db})
+	}
+	return p
+}
+
+func (p *ReplicaAwareConnectionProvider) CurrentConnection(ctx context.Context) Conn {
+	if !IsReadOnly(ctx) {
+		return p.primary
+	}
+	replicas := p.caughtUp(ctx, p.HealthyReplicas())
+	if len(replicas) == 0 {
+		return p.primary
+	}
+	return p.balancer.Choose(replicas)
+}
+
+func (p *ReplicaAwareConnectionProvider) Primary() *sql.DB {
+	return p.primary
+}
+
+func (p *ReplicaAwareConnectionProvider) HealthyReplicas() []*sql.DB {
+	healthy := make([]*sql.DB, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if atomic.LoadInt32(&r.unhealthy) == 0 {
+			healthy = append(healthy, r.db)
+		}
+	}
+	return healthy
+}
+
+// CheckHealth runs the health check of all the replicas once.
+func (p *ReplicaAwareConnectionProvider) CheckHealth(ctx context.Context) {
+	for _, r := range p.replicas {
+		var unhealthy int32
+		if err := p.healthCheck(ctx, r.db); err != nil {
+			unhealthy = 1
+		}
+		atomic.StoreInt32(&r.unhealthy, unhealthy)
+	}
+}
+
+// RunHealthCheck runs the health check periodically until the context is done.
+func (p *ReplicaAwareConnectionProvider) RunHealthCheck(ctx context.Context) {
+	runHealthCheck(ctx, p.healthCheckInterval, p.CheckHealth)
+}
+
+func runHealthCheck(ctx context.Context, interval time.Duration, check func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ShardingReplicaAwareConnectionProvider routes the shard key to the ReplicaAwareConnectionProvider of each shard.
+type ShardingReplicaAwareConnectionProvider struct {
+	shards           []*ReplicaAwareConnectionProvider
+	router           gotx.ShardRouter
+	shardKeyProvider ShardKeyProvider
+}
+
+// the router must return the index of shards.
+func NewShardingReplicaAwareConnectionProvider(shards []*ReplicaAwareConnectionProvider, router gotx.ShardRouter, shardKeyProvider ShardKeyProvider) *ShardingReplicaAwareConnectionProvider {
+	if len(shards) == 0 || router == nil {
+		panic(&gotx.ShardingConfigError{Reason: "shards and router are required"})
+	}
+	return &ShardingReplicaAwareConnectionProvider{
+		shards:           shards,
+		router:           router,
+		shardKeyProvider: shardKeyProvider,
+	}
+}
+
+// CurrentConnection panics if the shard can not be determined. Use ResolveConnection to get the error.
+func (p *ShardingReplicaAwareConnectionProvider) CurrentConnection(ctx context.Context) Conn {
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (p *ShardingReplicaAwareConnectionProvider) ResolveConnection(ctx context.Context) (Conn, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	index := p.router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(p.shards) {
+		return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: index, Size: len(p.shards)}
+	}
+	return p.shards[index].CurrentConnection(ctx), nil
+}
+
+// OnCommit remembers the position of the primary of the committed shard for the session.
+func (p *ShardingReplicaAwareConnectionProvider) OnCommit(ctx context.Context, conn Conn) {
+	for _, shard := range p.shards {
+		shard.OnCommit(ctx, conn)
+	}
+}
+
+// SessionToken returns the token of the current session in the shard determined by the shard key.
+func (p *ShardingReplicaAwareConnectionProvider) SessionToken(ctx context.Context) (SessionToken, bool) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return SessionToken{}, false
+	}
+	index := p.router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(p.shards) {
+		return SessionToken{}, false
+	}
+	return p.shards[index].SessionToken(ctx)
+}
+
+// RunHealthCheck runs the health check of the replicas of all the shards periodically until the context is done.
+func (p *ShardingReplicaAwareConnectionProvider) RunHealthCheck(ctx context.Context) {
+	runHealthCheck(ctx, p.shards[0].healthCheckInterval, func(ctx context.Context) {
+		for _, shard := range p.shards {
+			shard.CheckHealth(ctx)
+		}
+	})
+}
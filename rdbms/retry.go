@@ -0,0 +1,95 @@
+package gotx
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/knocknote/gotx"
+)
+
+// SQLStateRetryClassifier retries the transaction failed with the SQLSTATE.
+type SQLStateRetryClassifier struct {
+	states []string
+}
+
+// NewPostgresRetryClassifier retries serialization_failure(40001) and deadlock_detected(40P01).
+func NewPostgresRetryClassifier() gotx.RetryClassifier {
+	return NewSQLStateRetryClassifier("40001", "40P01")
+}
+
+func NewSQLStateRetryClassifier(states ...string) gotx.RetryClassifier {
+	return &SQLStateRetryClassifier{
+		states: states,
+	}
+}
+
+func (c *SQLStateRetryClassifier) IsRetryable(err error) bool {
+	state := sqlState(err)
+	for _, v := range c.states {
+		if v == state {
+			return true
+		}
+	}
+	return false
+}
+
+// MySQLRetryClassifier retries the transaction failed with the MySQL error number.
+type MySQLRetryClassifier struct {
+	numbers []uint64
+}
+
+// NewMySQLRetryClassifier retries ER_LOCK_DEADLOCK(1213) and ER_LOCK_WAIT_TIMEOUT(1205).
+func NewMySQLRetryClassifier() gotx.RetryClassifier {
+	return NewMySQLErrorNumberRetryClassifier(1213, 1205)
+}
+
+func NewMySQLErrorNumberRetryClassifier(numbers ...uint64) gotx.RetryClassifier {
+	return &MySQLRetryClassifier{
+		numbers: numbers,
+	}
+}
+
+func (c *MySQLRetryClassifier) IsRetryable(err error) bool {
+	number, ok := errorField(err, "Number")
+	if !ok {
+		return false
+	}
+	switch number.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return false
+	}
+	for _, v := range c.numbers {
+		if v == number.Uint() {
+			return true
+		}
+	}
+	return false
+}
+
+func sqlState(err error) string {
+	// pgx
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	// lib/pq
+	if code, ok := errorField(err, "Code"); ok && code.Kind() == reflect.String {
+		return code.String()
+	}
+	return ""
+}
+
+// errorField finds the field of the driver error in the chain without depending on the driver.
+func errorField(err error, name string) (reflect.Value, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		if f := v.FieldByName(name); f.IsValid() {
+			return f, true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,64 @@
+package gotx
+
+import (
+	"fmt"
+)
+
+// SavepointDialect builds the savepoint statements used by the nested transaction.
+type SavepointDialect interface {
+	CreateSavepoint(name string) string
+	RollbackToSavepoint(name string) string
+	ReleaseSavepoint(name string) string
+}
+
+// PostgreSQL
+type PostgresDialect struct {
+}
+
+func (d *PostgresDialect) CreateSavepoint(name string) string {
+	return fmt.Sprintf("SAVEPOINT %s", name)
+}
+
+func (d *PostgresDialect) RollbackToSavepoint(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", name)
+}
+
+func (d *PostgresDialect) ReleaseSavepoint(name string) string {
+	return fmt.Sprintf("RELEASE SAVEPOINT %s", name)
+}
+
+// MySQL
+type MySQLDialect struct {
+}
+
+func (d *MySQLDialect) CreateSavepoint(name string) string {
+	return fmt.Sprintf("SAVEPOINT `%s`", name)
+}
+
+func (d *MySQLDialect) RollbackToSavepoint(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT `%s`", name)
+}
+
+func (d *MySQLDialect) ReleaseSavepoint(name string) string {
+	return fmt.Sprintf("RELEASE SAVEPOINT `%s`", name)
+}
+
+// SQLite
+type SQLiteDialect struct {
+}
+
+func (d *SQLiteDialect) CreateSavepoint(name string) string {
+	return fmt.Sprintf("SAVEPOINT \"%s\"", name)
+}
+
+func (d *SQLiteDialect) RollbackToSavepoint(name string) string {
+	return fmt.Sprintf("ROLLBACK TO \"%s\"", name)
+}
+
+func (d *SQLiteDialect) ReleaseSavepoint(name string) string {
+	return fmt.Sprintf("RELEASE \"%s\"", name)
+}
+
+func savepointName(depth int) string {
+	return fmt.Sprintf("gotx_savepoint_%d", depth)
+}
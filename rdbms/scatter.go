@@ -0,0 +1,46 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/knocknote/gotx"
+)
+
+// ShardFunc is called with the client of each shard.
+type ShardFunc func(ctx context.Context, shard int, client Client) error
+
+// ShardQueryFunc returns the results of each shard.
+type ShardQueryFunc func(ctx context.Context, shard int, client Client) ([]interface{}, error)
+
+// Shards returns the connections of the current topology.
+func (p *ShardingConnectionProvider) Shards() []*sql.DB {
+	return p.topology.Load().(*Topology).DB
+}
+
+// ForEachShard calls fn for each shard in order. It stops at the first error.
+func (p *ShardingConnectionProvider) ForEachShard(ctx context.Context, fn ShardFunc) error {
+	shards := p.Shards()
+	return gotx.ForEachShard(ctx, len(shards), func(ctx context.Context, shard int) error {
+		return fn(ctx, shard, shards[shard])
+	})
+}
+
+// ScatterGather calls fn for each shard in parallel and merges the results.
+// If config.ReadOnly is true, fn is called in the read-only transaction of each shard.
+func (p *ShardingConnectionProvider) ScatterGather(ctx context.Context, fn ShardQueryFunc, config gotx.ScatterGatherConfig) ([]interface{}, error) {
+	shards := p.Shards()
+	return gotx.ScatterGather(ctx, len(shards), func(ctx context.Context, shard int) ([]interface{}, error) {
+		if !config.ReadOnly {
+			return fn(ctx, shard, shards[shard])
+		}
+		tx, err := shards[shard].BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		return fn(ctx, shard, tx)
+	}, config)
+}
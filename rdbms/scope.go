@@ -0,0 +1,90 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/knocknote/gotx"
+)
+
+type shardScopeKey struct {
+	connectionProvider ConnectionProvider
+}
+
+// shardBranch is the transaction of a shard in the scope.
+type shardBranch struct {
+	conn   Conn
+	client Client
+	// resource is owned by the transactor which began the branch.
+	resource interface{}
+}
+
+// shardScope begins the transaction lazily on each shard touched in the scope.
+type shardScope struct {
+	// ctx of the transactor, the transaction of each shard begins with it regardless of the caller of the client.
+	ctx      context.Context
+	mu       sync.Mutex
+	begin    func(ctx context.Context, conn Conn) (*shardBranch, error)
+	branches []*shardBranch
+	status   *gotx.DefaultTransactionStatus
+	// the first error to begin the transaction, the scope is rolled back if it exists.
+	err error
+}
+
+func newShardScope(ctx context.Context, status *gotx.DefaultTransactionStatus, begin func(ctx context.Context, conn Conn) (*shardBranch, error)) *shardScope {
+	return &shardScope{
+		ctx:    ctx,
+		begin:  begin,
+		status: status,
+	}
+}
+
+func withShardScope(ctx context.Context, connectionProvider ConnectionProvider, scope *shardScope) context.Context {
+	if scope == nil {
+		return context.WithValue(ctx, shardScopeKey{connectionProvider: connectionProvider}, nil)
+	}
+	return context.WithValue(ctx, shardScopeKey{connectionProvider: connectionProvider}, scope)
+}
+
+func currentShardScope(ctx context.Context, connectionProvider ConnectionProvider) *shardScope {
+	scope, _ := ctx.Value(shardScopeKey{connectionProvider: connectionProvider}).(*shardScope)
+	return scope
+}
+
+// client returns the error to begin the transaction of the shard. The scope is rolled back even if the caller ignores it.
+func (s *shardScope) client(conn Conn) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, branch := range s.branches {
+		if branch.conn == conn {
+			return branch.client, nil
+		}
+	}
+	branch, err := s.begin(s.ctx, conn)
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return nil, err
+	}
+	s.branches = append(s.branches, branch)
+	return branch.client, nil
+}
+
+// connClient runs the query on the dedicated connection.
+type connClient struct {
+	*sql.Conn
+}
+
+func (c *connClient) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c *connClient) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c *connClient) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
@@ -0,0 +1,146 @@
+package gotx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/knocknote/gotx"
+)
+
+// PartialCommitError is returned when some shards are committed and the others are not.
+type PartialCommitError struct {
+	Committed int
+	Total     int
+	Err       error
+}
+
+func (e *PartialCommitError) Error() string {
+	return fmt.Sprintf("%d of %d shards are committed: %v", e.Committed, e.Total, e.Err)
+}
+
+func (e *PartialCommitError) Unwrap() error {
+	return e.Err
+}
+
+// ScopedTransactor begins the transaction lazily on each shard resolved by the ClientProvider in the scope,
+// and commits or rolls back all of them at the end. The commit is not atomic across the shards, use XATransactor for it.
+// Use the same ConnectionProvider for the ScopedTransactor and the ClientProvider.
+type ScopedTransactor struct {
+	connectionProvider ConnectionProvider
+}
+
+func NewScopedTransactor(connectionProvider ConnectionProvider) gotx.Transactor {
+	return &ScopedTransactor{
+		connectionProvider: connectionProvider,
+	}
+}
+
+func (t *ScopedTransactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *ScopedTransactor) Supports(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return fn(ctx)
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *ScopedTransactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return gotx.NewMandatoryError()
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *ScopedTransactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	if currentShardScope(ctx, t.connectionProvider) != nil {
+		return gotx.NewNeverError()
+	}
+	return fn(ctx)
+}
+
+func (t *ScopedTransactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(gotx.WithStatus(withShardScope(ctx, t.connectionProvider, nil), nil))
+}
+
+func (t *ScopedTransactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	if currentShardScope(ctx, t.connectionProvider) != nil {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "rdbms scope"}
+	}
+	return t.RequiresNew(ctx, fn, options...)
+}
+
+func (t *ScopedTransactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) (err error) {
+	config := newConfig(options)
+	txOptions := &sql.TxOptions{
+		Isolation: isolationLevel(config),
+		ReadOnly:  config.ReadOnly,
+	}
+	status := gotx.NewTransactionStatus("rdbms", true, config)
+	scope := newShardScope(ctx, status, func(ctx context.Context, conn Conn) (*shardBranch, error) {
+		tx, err := conn.BeginTx(ctx, txOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &shardBranch{conn: conn, client: tx, resource: tx}, nil
+	})
+	// the read-only transaction begins on the replica of each shard.
+	txCtx := gotx.WithStatus(withShardScope(withReadOnly(ctx, config.ReadOnly), t.connectionProvider, scope), status)
+	defer func() {
+		if p := recover(); p != nil {
+			t.rollback(scope.branches)
+			status.TriggerAfterRollback(ctx)
+			panic(p)
+		}
+		err = t.complete(ctx, txCtx, scope, config, err)
+	}()
+	err = fn(txCtx)
+	return
+}
+
+func (t *ScopedTransactor) complete(ctx context.Context, txCtx context.Context, scope *shardScope, config gotx.Config, err error) error {
+	if err == nil {
+		err = scope.err
+	}
+	if config.ShouldRollback(err) || scope.status.IsRollbackOnly() {
+		t.rollback(scope.branches)
+		scope.status.TriggerAfterRollback(ctx)
+		return err
+	}
+	if syncErr := scope.status.TriggerBeforeCommit(txCtx); syncErr != nil {
+		t.rollback(scope.branches)
+		scope.status.TriggerAfterRollback(ctx)
+		return syncErr
+	}
+	// commit in the order of the first access
+	for i, branch := range scope.branches {
+		if commitErr := branch.resource.(*sql.Tx).Commit(); commitErr != nil {
+			t.rollback(scope.branches[i+1:])
+			scope.status.TriggerAfterRollback(ctx)
+			if i == 0 {
+				return commitErr
+			}
+			return &PartialCommitError{Committed: i, Total: len(scope.branches), Err: commitErr}
+		}
+		if !config.ReadOnly {
+			notifyCommit(ctx, t.connectionProvider, branch.conn)
+		}
+	}
+	scope.status.TriggerAfterCommit(ctx)
+	// the error matched with the no rollback rule is returned after commit.
+	return err
+}
+
+func (t *ScopedTransactor) rollback(branches []*shardBranch) {
+	for _, branch := range branches {
+		_ = branch.resource.(*sql.Tx).Rollback()
+	}
+}
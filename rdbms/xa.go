@@ -0,0 +1,567 @@
+package gotx
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/knocknote/gotx"
+)
+
+// XADialect builds the statements of the two-phase commit.
+type XADialect interface {
+	Begin(xid string) []string
+	Prepare(xid string) []string
+	// Rollback rolls back the transaction which is not prepared.
+	Rollback(xid string) []string
+	CommitPrepared(xid string) string
+	RollbackPrepared(xid string) string
+	// Recover returns the xid of the prepared transactions.
+	Recover(ctx context.Context, conn Conn) ([]string, error)
+}
+
+// PostgreSQL requires max_prepared_transactions to be greater than zero.
+type PostgresXADialect struct {
+}
+
+func (d *PostgresXADialect) Begin(_ string) []string {
+	return []string{"BEGIN"}
+}
+
+func (d *PostgresXADialect) Prepare(xid string) []string {
+	return []string{fmt.Sprintf("PREPARE TRANSACTION '%s'", xid)}
+}
+
+func (d *PostgresXADialect) Rollback(_ string) []string {
+	return []string{"ROLLBACK"}
+}
+
+func (d *PostgresXADialect) CommitPrepared(xid string) string {
+	return fmt.Sprintf("COMMIT PREPARED '%s'", xid)
+}
+
+func (d *PostgresXADialect) RollbackPrepared(xid string) string {
+	return fmt.Sprintf("ROLLBACK PREPARED '%s'", xid)
+}
+
+func (d *PostgresXADialect) Recover(ctx context.Context, conn Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT gid FROM pg_prepared_xacts WHERE database = current_database()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []string
+	for rows.Next() {
+		var xid string
+		if err = rows.Scan(&xid); err != nil {
+			return nil, err
+		}
+		xids = append(xids, xid)
+	}
+	return xids, rows.Err()
+}
+
+// MySQL
+type MySQLXADialect struct {
+}
+
+func (d *MySQLXADialect) Begin(xid string) []string {
+	return []string{fmt.Sprintf("XA START '%s'", xid)}
+}
+
+func (d *MySQLXADialect) Prepare(xid string) []string {
+	return []string{fmt.Sprintf("XA END '%s'", xid), fmt.Sprintf("XA PREPARE '%s'", xid)}
+}
+
+func (d *MySQLXADialect) Rollback(xid string) []string {
+	return []string{fmt.Sprintf("XA END '%s'", xid), fmt.Sprintf("XA ROLLBACK '%s'", xid)}
+}
+
+func (d *MySQLXADialect) CommitPrepared(xid string) string {
+	return fmt.Sprintf("XA COMMIT '%s'", xid)
+}
+
+func (d *MySQLXADialect) RollbackPrepared(xid string) string {
+	return fmt.Sprintf("XA ROLLBACK '%s'", xid)
+}
+
+func (d *MySQLXADialect) Recover(ctx context.Context, conn Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []string
+	for rows.Next() {
+		var formatID, gtridLength, bqualLength int
+		var data string
+		if err = rows.Scan(&formatID, &gtridLength, &bqualLength, &data); err != nil {
+			return nil, err
+		}
+		if gtridLength <= len(data) {
+			data = data[:gtridLength]
+		}
+		xids = append(xids, data)
+	}
+	return xids, rows.Err()
+}
+
+// ------------------------------------
+// Coordinator Log
+// ------------------------------------
+
+type XABranch struct {
+	// Shard is the index of the shards given to the XATransactor.
+	Shard int    `json:"shard"`
+	XID   string `json:"xid"`
+}
+
+type XARecord struct {
+	GTRID    string     `json:"gtrid"`
+	Branches []XABranch `json:"branches"`
+}
+
+// CoordinatorLog records the commit decision of the two-phase commit.
+type CoordinatorLog interface {
+	// LogCommit durably records the commit decision before the prepared transactions are committed.
+	LogCommit(ctx context.Context, record *XARecord) error
+	// LogComplete records that all the prepared transactions are committed.
+	LogComplete(ctx context.Context, gtrid string) error
+	// Pending returns the commit decisions which are not completed.
+	Pending(ctx context.Context) ([]*XARecord, error)
+}
+
+type fileLogEntry struct {
+	Commit   *XARecord `json:"commit,omitempty"`
+	Complete string    `json:"complete,omitempty"`
+}
+
+// FileCoordinatorLog appends the decisions to the file and syncs it for each write.
+type FileCoordinatorLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileCoordinatorLog(path string) *FileCoordinatorLog {
+	return &FileCoordinatorLog{
+		path: path,
+	}
+}
+
+func (l *FileCoordinatorLog) LogCommit(_ context.Context, record *XARecord) error {
+	return l.append(&fileLogEntry{Commit: record})
+}
+
+func (l *FileCoordinatorLog) LogComplete(_ context.Context, gtrid string) error {
+	return l.append(&fileLogEntry{Complete: gtrid})
+}
+
+func (l *FileCoordinatorLog) append(entry *fileLogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (l *FileCoordinatorLog) Pending(_ context.Context) ([]*XARecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var records []*XARecord
+	completed := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry fileLogEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line may be broken by the crash before sync.
+			continue
+		}
+		if entry.Commit != nil {
+			records = append(records, entry.Commit)
+		} else if entry.Complete != "" {
+			completed[entry.Complete] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	var pending []*XARecord
+	for _, record := range records {
+		if !completed[record.GTRID] {
+			pending = append(pending, record)
+		}
+	}
+	return pending, nil
+}
+
+// ------------------------------------
+// XA Transactor
+// ------------------------------------
+
+// InDoubtTransactionError is returned when the commit is decided but some prepared transactions are not committed.
+// They are committed by XATransactor.Recover. The outcome is unknown until then, so only AfterCompletion is invoked with committed=true.
+type InDoubtTransactionError struct {
+	GTRID string
+	Err   error
+}
+
+func (e *InDoubtTransactionError) Error() string {
+	return fmt.Sprintf("transaction %s is in doubt: %v", e.GTRID, e.Err)
+}
+
+func (e *InDoubtTransactionError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedOptionError is returned when the option cannot be applied to the xa transaction.
+type UnsupportedOptionError struct {
+	Option string
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("%s is not supported by the xa transaction", e.Option)
+}
+
+type XATransactorConfig struct {
+	Dialect XADialect
+	Log     CoordinatorLog
+	// CoordinatorID is required to identify the prepared transactions owned by this coordinator.
+	// It must be unique for each application instance and stable across the restarts, such as the pod name of the StatefulSet.
+	// Recover never touches the prepared transactions of the other coordinators.
+	// Only letters, digits, '_' and '.' are allowed. Keep it short because MySQL limits the xid to 64 bytes.
+	CoordinatorID string
+	// XIDPrefix is prepended to the xid. default is gotx. The same characters as CoordinatorID are allowed.
+	XIDPrefix string
+}
+
+var xidPartPattern = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// XATransactor opens the transaction on every shard touched in the scope and commits them with the two-phase commit.
+// Use the same ConnectionProvider for the XATransactor and the ClientProvider.
+type XATransactor struct {
+	shards             []*sql.DB
+	connectionProvider ConnectionProvider
+	dialect            XADialect
+	log                CoordinatorLog
+	// xid of this coordinator starts with this.
+	xidPrefix string
+}
+
+// NewXATransactor panics with ShardingConfigError if CoordinatorID is empty or XIDPrefix or CoordinatorID contains the invalid character.
+func NewXATransactor(shards []*sql.DB, connectionProvider ConnectionProvider, config XATransactorConfig) *XATransactor {
+	if config.XIDPrefix == "" {
+		config.XIDPrefix = "gotx"
+	}
+	if !xidPartPattern.MatchString(config.CoordinatorID) || !xidPartPattern.MatchString(config.XIDPrefix) {
+		panic(&gotx.ShardingConfigError{Reason: fmt.Sprintf("invalid coordinator id %q or xid prefix %q of the xa transactor", config.CoordinatorID, config.XIDPrefix)})
+	}
+	return &XATransactor{
+		shards:             shards,
+		connectionProvider: connectionProvider,
+		dialect:            config.Dialect,
+		log:                config.Log,
+		xidPrefix:          config.XIDPrefix + "-" + config.CoordinatorID + "-",
+	}
+}
+
+func (t *XATransactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *XATransactor) Supports(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return fn(ctx)
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *XATransactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	scope := currentShardScope(ctx, t.connectionProvider)
+	if scope == nil {
+		return gotx.NewMandatoryError()
+	}
+	return fn(gotx.WithStatus(ctx, scope.status.Join()))
+}
+
+func (t *XATransactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	if currentShardScope(ctx, t.connectionProvider) != nil {
+		return gotx.NewNeverError()
+	}
+	return fn(ctx)
+}
+
+func (t *XATransactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	return fn(gotx.WithStatus(withShardScope(ctx, t.connectionProvider, nil), nil))
+}
+
+func (t *XATransactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	if currentShardScope(ctx, t.connectionProvider) != nil {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "rdbms xa"}
+	}
+	return t.RequiresNew(ctx, fn, options...)
+}
+
+// xa transaction of the shard
+type xaBranch struct {
+	XABranch
+	conn     *sql.Conn
+	prepared bool
+}
+
+func (t *XATransactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) (err error) {
+	config := newConfig(options)
+	// the xa transaction is begun by the dialect, which cannot set the read-only mode or the isolation level.
+	if config.ReadOnly {
+		return &UnsupportedOptionError{Option: "read-only"}
+	}
+	if config.Isolation != sql.LevelDefault {
+		return &UnsupportedOptionError{Option: "isolation level " + config.Isolation.String()}
+	}
+	gtrid, err := newGTRID()
+	if err != nil {
+		return err
+	}
+	status := gotx.NewTransactionStatus("rdbms", true, config)
+	scope := newShardScope(ctx, status, func(ctx context.Context, conn Conn) (*shardBranch, error) {
+		return t.begin(ctx, gtrid, conn)
+	})
+	txCtx := gotx.WithStatus(withShardScope(ctx, t.connectionProvider, scope), status)
+	defer func() {
+		if p := recover(); p != nil {
+			t.rollback(ctx, scope)
+			status.TriggerAfterRollback(ctx)
+			panic(p)
+		}
+		err = t.complete(ctx, txCtx, gtrid, scope, config, err)
+	}()
+	err = fn(txCtx)
+	return
+}
+
+func (t *XATransactor) begin(ctx context.Context, gtrid string, conn Conn) (*shardBranch, error) {
+	shard := -1
+	for i, db := range t.shards {
+		if Conn(db) == conn {
+			shard = i
+			break
+		}
+	}
+	if shard < 0 {
+		return nil, errors.New("the connection is not the shard of the xa transactor")
+	}
+	dedicated, err := t.shards[shard].Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	branch := &xaBranch{
+		XABranch: XABranch{Shard: shard, XID: fmt.Sprintf("%s%s-%d", t.xidPrefix, gtrid, shard)},
+		conn:     dedicated,
+	}
+	if err = execAll(ctx, dedicated, t.dialect.Begin(branch.XID)); err != nil {
+		discard(dedicated)
+		return nil, err
+	}
+	return &shardBranch{
+		conn:     conn,
+		client:   &connClient{Conn: dedicated},
+		resource: branch,
+	}, nil
+}
+
+func (t *XATransactor) complete(ctx context.Context, txCtx context.Context, gtrid string, scope *shardScope, config gotx.Config, err error) error {
+	if err == nil {
+		err = scope.err
+	}
+	if config.ShouldRollback(err) || scope.status.IsRollbackOnly() {
+		t.rollback(ctx, scope)
+		scope.status.TriggerAfterRollback(ctx)
+		return err
+	}
+	if syncErr := scope.status.TriggerBeforeCommit(txCtx); syncErr != nil {
+		t.rollback(ctx, scope)
+		scope.status.TriggerAfterRollback(ctx)
+		return syncErr
+	}
+	if len(scope.branches) == 0 {
+		scope.status.TriggerAfterCommit(ctx)
+		return err
+	}
+	if t.log == nil {
+		t.rollback(ctx, scope)
+		scope.status.TriggerAfterRollback(ctx)
+		return errors.New("coordinator log is required for the xa transaction")
+	}
+	record := &XARecord{GTRID: gtrid}
+	// phase 1
+	for _, branch := range scope.branches {
+		b := branch.resource.(*xaBranch)
+		if prepareErr := execAll(ctx, b.conn, t.dialect.Prepare(b.XID)); prepareErr != nil {
+			t.rollback(ctx, scope)
+			scope.status.TriggerAfterRollback(ctx)
+			return prepareErr
+		}
+		b.prepared = true
+		record.Branches = append(record.Branches, b.XABranch)
+	}
+	// the transaction is rolled back by the recovery without the commit decision.
+	if logErr := t.log.LogCommit(ctx, record); logErr != nil {
+		t.rollback(ctx, scope)
+		scope.status.TriggerAfterRollback(ctx)
+		return logErr
+	}
+	// phase 2
+	var commitErr error
+	for _, branch := range scope.branches {
+		b := branch.resource.(*xaBranch)
+		if _, e := b.conn.ExecContext(ctx, t.dialect.CommitPrepared(b.XID)); e != nil {
+			if commitErr == nil {
+				commitErr = e
+			}
+			discard(b.conn)
+			continue
+		}
+		_ = b.conn.Close()
+	}
+	if commitErr != nil {
+		scope.status.TriggerAfterCompletion(ctx, true)
+		return &InDoubtTransactionError{GTRID: gtrid, Err: commitErr}
+	}
+	_ = t.log.LogComplete(ctx, gtrid)
+	scope.status.TriggerAfterCommit(ctx)
+	// the error matched with the no rollback rule is returned after commit.
+	return err
+}
+
+func (t *XATransactor) rollback(ctx context.Context, scope *shardScope) {
+	for _, branch := range scope.branches {
+		b := branch.resource.(*xaBranch)
+		var err error
+		if b.prepared {
+			_, err = b.conn.ExecContext(ctx, t.dialect.RollbackPrepared(b.XID))
+		} else {
+			err = execAll(ctx, b.conn, t.dialect.Rollback(b.XID))
+		}
+		if err != nil {
+			discard(b.conn)
+			continue
+		}
+		_ = b.conn.Close()
+	}
+}
+
+// discard closes the connection without returning it to the pool because it may be still in the transaction.
+func discard(conn *sql.Conn) {
+	_ = conn.Raw(func(_ interface{}) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
+
+// Recover resolves the in-doubt transactions after the crash. It should be called on startup before any transaction begins.
+// The prepared transactions with the commit decision are committed, and the others owned by this coordinator are rolled back.
+// The prepared transactions of the other coordinators are never touched.
+func (t *XATransactor) Recover(ctx context.Context) error {
+	pending, err := t.log.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	decided := map[string]bool{}
+	for _, record := range pending {
+		for _, branch := range record.Branches {
+			decided[branch.XID] = true
+		}
+	}
+	prepared := make([]map[string]bool, len(t.shards))
+	for i, db := range t.shards {
+		xids, err := t.dialect.Recover(ctx, db)
+		if err != nil {
+			return err
+		}
+		prepared[i] = map[string]bool{}
+		for _, xid := range xids {
+			if !strings.HasPrefix(xid, t.xidPrefix) {
+				continue
+			}
+			prepared[i][xid] = true
+			if !decided[xid] {
+				if _, err = db.ExecContext(ctx, t.dialect.RollbackPrepared(xid)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, record := range pending {
+		for _, branch := range record.Branches {
+			if branch.Shard >= len(t.shards) || !prepared[branch.Shard][branch.XID] {
+				// already committed
+				continue
+			}
+			if _, err = t.shards[branch.Shard].ExecContext(ctx, t.dialect.CommitPrepared(branch.XID)); err != nil {
+				return err
+			}
+		}
+		if err = t.log.LogComplete(ctx, record.GTRID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func execAll(ctx context.Context, conn execer, statements []string) error {
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newGTRID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,133 @@
+package gotx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/knocknote/gotx"
+
+	"github.com/go-redis/redis"
+)
+
+// CrossSlotError is returned before sending the transaction whose keys are mapped to the different slots of the Redis Cluster.
+type CrossSlotError struct {
+	Keys  []string
+	Slots []uint32
+}
+
+func (e *CrossSlotError) Error() string {
+	keys := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		keys[i] = fmt.Sprintf("%s (slot %d)", key, e.Slots[i])
+	}
+	return fmt.Sprintf("CROSSSLOT keys in the transaction don't hash to the same slot: %s. "+
+		"use the hash tag such as {user1}.profile and {user1}.items to map the keys to the same slot", strings.Join(keys, ", "))
+}
+
+// checkSlot returns CrossSlotError if the keys are mapped to the different slots.
+func checkSlot(keys []string) error {
+	if len(keys) < 2 {
+		return nil
+	}
+	first := gotx.RedisClusterSlot([]byte(keys[0]))
+	for _, key := range keys[1:] {
+		if gotx.RedisClusterSlot([]byte(key)) == first {
+			continue
+		}
+		e := &CrossSlotError{}
+		for _, k := range keys {
+			e.Keys = append(e.Keys, k)
+			e.Slots = append(e.Slots, gotx.RedisClusterSlot([]byte(k)))
+		}
+		return e
+	}
+	return nil
+}
+
+// isCluster reports whether the keys of the transaction must be in the same slot.
+func isCluster(client redis.UniversalClient) bool {
+	_, ok := client.(*redis.ClusterClient)
+	return ok
+}
+
+// withSlotCheck returns the copy of the cluster client which checks the slots of the keys before sending the transaction.
+// The other clients are returned as is.
+func withSlotCheck(client redis.UniversalClient) redis.UniversalClient {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return client
+	}
+	checked := cluster.WithContext(cluster.Context())
+	checked.WrapProcessPipeline(slotCheck)
+	return checked
+}
+
+func slotCheck(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+	return func(cmds []redis.Cmder) error {
+		if err := checkSlot(commandKeys(cmds)); err != nil {
+			return err
+		}
+		return process(cmds)
+	}
+}
+
+// commandKeys returns the keys of the commands.
+func commandKeys(cmds []redis.Cmder) []string {
+	var keys []string
+	for _, cmd := range cmds {
+		keys = append(keys, keysOf(cmd.Args())...)
+	}
+	return keys
+}
+
+// keysOf returns the keys in the arguments. The first argument is the key unless the command is listed here.
+func keysOf(args []interface{}) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	var positions []int
+	switch strings.ToLower(formatValue(args[0])) {
+	case "del", "unlink", "exists", "touch", "mget", "watch", "sinter", "sunion", "sdiff",
+		"sinterstore", "sunionstore", "sdiffstore", "pfcount", "pfmerge":
+		for i := 1; i < len(args); i++ {
+			positions = append(positions, i)
+		}
+	case "mset", "msetnx":
+		for i := 1; i < len(args); i += 2 {
+			positions = append(positions, i)
+		}
+	case "rename", "renamenx", "smove", "rpoplpush", "brpoplpush":
+		positions = []int{1, 2}
+	case "zunionstore", "zinterstore":
+		positions = []int{1}
+		positions = append(positions, numKeys(args, 2)...)
+	case "eval", "evalsha":
+		positions = numKeys(args, 2)
+	default:
+		positions = []int{1}
+	}
+	keys := make([]string, 0, len(positions))
+	for _, i := range positions {
+		if i < len(args) {
+			keys = append(keys, formatValue(args[i]))
+		}
+	}
+	return keys
+}
+
+// numKeys returns the positions of the keys following the number of the keys at the position.
+func numKeys(args []interface{}, position int) []int {
+	if position >= len(args) {
+		return nil
+	}
+	n, err := strconv.Atoi(formatValue(args[position]))
+	if err != nil || n < 0 {
+		return nil
+	}
+	positions := make([]int, n)
+	for i := range positions {
+		positions[i] = position + 1 + i
+	}
+	return positions
+}
@@ -0,0 +1,200 @@
+package gotx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/knocknote/gotx"
+
+	"github.com/go-redis/redis"
+)
+
+// MigratingConnectionProvider routes the shard key by the MigratingShardRouter during the online resharding.
+type MigratingConnectionProvider struct {
+	db               []redis.UniversalClient
+	router           *gotx.MigratingShardRouter
+	shardKeyProvider ShardKeyProvider
+}
+
+// db is the clients of all the shards in the new slot map.
+// It panics with ShardingConfigError if the slot maps use more shards than db.
+func NewMigratingConnectionProvider(db []*redis.Client, router *gotx.MigratingShardRouter, shardKeyProvider ShardKeyProvider) *MigratingConnectionProvider {
+	return NewMigratingConnectionProviderUniversal(universalClients(db), router, shardKeyProvider)
+}
+
+// NewMigratingConnectionProviderUniversal accepts the cluster or failover clients as db.
+func NewMigratingConnectionProviderUniversal(db []redis.UniversalClient, router *gotx.MigratingShardRouter, shardKeyProvider ShardKeyProvider) *MigratingConnectionProvider {
+	if len(db) == 0 || router == nil {
+		panic(&gotx.ShardingConfigError{Reason: "connections and router are required"})
+	}
+	if router.Size() > len(db) {
+		panic(&gotx.ShardingConfigError{Reason: fmt.Sprintf("slot maps use %d shards for %d clients", router.Size(), len(db))})
+	}
+	return &MigratingConnectionProvider{
+		db:               db,
+		router:           router,
+		shardKeyProvider: shardKeyProvider,
+	}
+}
+
+// CurrentConnection returns the client of the new shard.
+func (p *MigratingConnectionProvider) CurrentConnection(ctx context.Context) redis.UniversalClient {
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (p *MigratingConnectionProvider) ResolveConnection(ctx context.Context) (redis.UniversalClient, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	index := p.router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(p.db) {
+		return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: index, Size: len(p.db)}
+	}
+	return p.db[index], nil
+}
+
+// WriteConnections returns the clients of the new shard and the old shard if the slot is migrating.
+func (p *MigratingConnectionProvider) WriteConnections(ctx context.Context) ([]redis.UniversalClient, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return p.connections(shardKey, p.router.WriteShards([]byte(shardKey)))
+}
+
+// ReadConnections returns the clients in the order of the fallback.
+func (p *MigratingConnectionProvider) ReadConnections(ctx context.Context) ([]redis.UniversalClient, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return p.connections(shardKey, p.router.ReadShards([]byte(shardKey)))
+}
+
+func (p *MigratingConnectionProvider) connections(shardKey string, shards []int) ([]redis.UniversalClient, error) {
+	clients := make([]redis.UniversalClient, len(shards))
+	for i, shard := range shards {
+		if shard < 0 || shard >= len(p.db) {
+			return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: shard, Size: len(p.db)}
+		}
+		clients[i] = p.db[shard]
+	}
+	return clients, nil
+}
+
+// Switch completes the migration at runtime.
+func (p *MigratingConnectionProvider) Switch() {
+	p.router.Switch()
+}
+
+// SecondaryWriteError is reported when the commands to the old shard fail after the new shard is committed.
+// The old shard misses the writes of Cmds. Apply them to the old shard again before the slot is copied,
+// otherwise the Copier copies the stale data to the new shard.
+type SecondaryWriteError struct {
+	Cmds []redis.Cmder
+	Err  error
+}
+
+func (e *SecondaryWriteError) Error() string {
+	return fmt.Sprintf("%d commands to the old shard failed after commit: %v", len(e.Cmds), e.Err)
+}
+
+func (e *SecondaryWriteError) Unwrap() error {
+	return e.Err
+}
+
+type MigratingClientProviderConfig struct {
+	// OnSecondaryError is called when the commands to the old shard fail after the commit of the new shard.
+	OnSecondaryError func(ctx context.Context, err *SecondaryWriteError)
+}
+
+// MigratingClientProvider returns the clients in the transaction of the Transactor with the MigratingConnectionProvider.
+type MigratingClientProvider struct {
+	DefaultClientProvider
+	migratingConnectionProvider *MigratingConnectionProvider
+	onSecondaryError            func(ctx context.Context, err *SecondaryWriteError)
+}
+
+func NewMigratingClientProvider(connectionProvider *MigratingConnectionProvider, shardKeyProvider ShardKeyProvider) *MigratingClientProvider {
+	return NewMigratingClientProviderWithConfig(connectionProvider, shardKeyProvider, MigratingClientProviderConfig{})
+}
+
+func NewMigratingClientProviderWithConfig(connectionProvider *MigratingConnectionProvider, shardKeyProvider ShardKeyProvider, config MigratingClientProviderConfig) *MigratingClientProvider {
+	return &MigratingClientProvider{
+		DefaultClientProvider: DefaultClientProvider{
+			shardKeyProvider:   shardKeyProvider,
+			connectionProvider: connectionProvider,
+		},
+		migratingConnectionProvider: connectionProvider,
+		onSecondaryError:            config.OnSecondaryError,
+	}
+}
+
+// WriteClients returns the writers of both the new shard and the old shard.
+// In the transaction, the commands to the old shard are executed in the MULTI/EXEC just after the commit of the new shard,
+// so the old shard never has the writes rolled back in the new shard. The failure is reported to OnSecondaryError.
+func (p *MigratingClientProvider) WriteClients(ctx context.Context) ([]redis.Cmdable, error) {
+	clients, err := p.migratingConnectionProvider.WriteConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentTransaction(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	writers := make([]redis.Cmdable, len(clients))
+	for i, client := range clients {
+		switch {
+		case current == nil:
+			writers[i] = client
+		case i == 0:
+			writers[i] = current.Pipeliner
+		default:
+			writers[i] = current.secondary(client, p.onSecondaryError)
+		}
+	}
+	return writers, nil
+}
+
+// ReadClients returns the readers in the order of the fallback.
+func (p *MigratingClientProvider) ReadClients(ctx context.Context) ([]redis.Cmdable, error) {
+	clients, err := p.migratingConnectionProvider.ReadConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]redis.Cmdable, len(clients))
+	for i, client := range clients {
+		readers[i] = client
+	}
+	return readers, nil
+}
+
+func (t *transaction) secondary(client redis.UniversalClient, onError func(ctx context.Context, err *SecondaryWriteError)) redis.Pipeliner {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pipe, ok := t.secondaries[client]; ok {
+		return pipe
+	}
+	if t.secondaries == nil {
+		t.secondaries = map[redis.UniversalClient]redis.Pipeliner{}
+	}
+	pipe := withSlotCheck(client).TxPipeline()
+	t.secondaries[client] = pipe
+	t.status.RegisterSynchronization(gotx.SynchronizationFuncs{
+		OnAfterCommit: func(ctx context.Context) {
+			cmds, err := pipe.Exec()
+			if err != nil && onError != nil {
+				onError(ctx, &SecondaryWriteError{Cmds: cmds, Err: err})
+			}
+		},
+		OnAfterRollback: func(ctx context.Context) {
+			_ = pipe.Close()
+		},
+	})
+	return pipe
+}
@@ -0,0 +1,48 @@
+package gotx
+
+import (
+	"github.com/knocknote/gotx"
+)
+
+// vendorOption is the redis specific options stored in gotx.Config.VendorOption.
+type vendorOption struct {
+	watch         bool
+	watchKeys     []string
+	watchAttempts int
+	overlay       bool
+	preconditions []Precondition
+}
+
+func (o *vendorOption) maxAttempts() int {
+	if o.watchAttempts <= 0 {
+		return 3
+	}
+	return o.watchAttempts
+}
+
+func currentVendorOption(c *gotx.Config) *vendorOption {
+	if current, ok := c.VendorOption.(*vendorOption); ok {
+		return current
+	}
+	current := &vendorOption{}
+	c.VendorOption = current
+	return current
+}
+
+func vendorOptionOf(c gotx.Config) *vendorOption {
+	if current, ok := c.VendorOption.(*vendorOption); ok {
+		return current
+	}
+	return &vendorOption{}
+}
+
+// Overlay makes the writes in the transaction visible to the reader of the ClientProvider.
+type Overlay struct{}
+
+func (o Overlay) Apply(c *gotx.Config) {
+	currentVendorOption(c).overlay = true
+}
+
+func OptionOverlay() Overlay {
+	return Overlay{}
+}
@@ -0,0 +1,864 @@
+package gotx
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// OverlayError is returned by the reader of OptionOverlay for the written key whose value can not be merged with the writes.
+// The key is written by the command the overlay does not model, or it is read by the command the overlay does not merge.
+// Key is empty if the command such as SCAN may read any written key.
+type OverlayError struct {
+	Key    string
+	Reason string
+}
+
+func (e *OverlayError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis: overlay can not read the written keys before EXEC: %s", e.Reason)
+	}
+	return fmt.Sprintf("redis: overlay can not read %s before EXEC: %s", e.Key, e.Reason)
+}
+
+var (
+	errWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errSyntax     = errors.New("ERR syntax error")
+)
+
+// detached is never connected. Its pipelines are used to collect the commands.
+var detached = redis.NewClient(&redis.Options{IdleTimeout: -1})
+
+// newCollector returns the pipeline whose Exec returns the queued commands without sending them.
+func newCollector() redis.Pipeliner {
+	client := detached.WithContext(context.Background())
+	client.WrapProcessPipeline(func(_ func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(_ []redis.Cmder) error {
+			return nil
+		}
+	})
+	return client.Pipeline()
+}
+
+// the commands which do not change the values.
+var overlayReads = map[string]bool{
+	"get": true, "mget": true, "strlen": true, "getrange": true, "getbit": true, "bitcount": true, "bitpos": true,
+	"exists": true, "type": true, "ttl": true, "pttl": true, "dump": true, "touch": true,
+	"hget": true, "hmget": true, "hgetall": true, "hexists": true, "hlen": true, "hkeys": true, "hvals": true, "hscan": true,
+	"smembers": true, "sismember": true, "scard": true, "srandmember": true, "sinter": true, "sunion": true, "sdiff": true, "sscan": true,
+	"zscore": true, "zcard": true, "zcount": true, "zlexcount": true, "zrange": true, "zrevrange": true, "zrangebyscore": true,
+	"zrevrangebyscore": true, "zrangebylex": true, "zrevrangebylex": true, "zrank": true, "zrevrank": true, "zscan": true,
+	"lrange": true, "llen": true, "lindex": true, "pfcount": true, "echo": true, "ping": true,
+}
+
+// overlay applies the writes in the transaction to the entries so that the reader sees them before EXEC.
+// The strings and hashes written by the commands in apply are merged with the values on the server.
+// The key written by the other commands, or by the command which fails at EXEC, is tainted and can not be read until the end of the transaction.
+type overlay struct {
+	mu   sync.Mutex
+	base overlayBase
+	// writer collects the commands. They are applied before each read and queued to the transaction at the end.
+	writer  redis.Pipeliner
+	cmds    []redis.Cmder
+	entries map[string]*overlayEntry
+}
+
+type overlayEntry struct {
+	// the value on the server is ignored if deleted is true.
+	deleted bool
+	// string or hash. it is empty if only the expiration is changed.
+	kind  string
+	value *string
+	// nil value is the deleted field.
+	fields map[string]*string
+	// nil is the expiration on the server and the negative value is no expiration.
+	ttl *time.Duration
+	// the reason why the value is unknown until EXEC.
+	tainted string
+}
+
+func newOverlay(base overlayBase) *overlay {
+	return &overlay{
+		base:    base,
+		writer:  newCollector(),
+		entries: map[string]*overlayEntry{},
+	}
+}
+
+// lock locks the overlay after applying the commands collected since the last read.
+func (o *overlay) lock() {
+	o.mu.Lock()
+	cmds, _ := o.writer.Exec()
+	for _, cmd := range cmds {
+		o.cmds = append(o.cmds, cmd)
+		args := cmd.Args()
+		if len(args) < 2 {
+			continue
+		}
+		name := strings.ToLower(formatValue(args[0]))
+		if overlayReads[name] {
+			continue
+		}
+		keys := keysOf(args)
+		reason := ""
+		for _, key := range keys {
+			if e := o.entries[key]; e != nil && e.tainted != "" {
+				reason = e.tainted
+				break
+			}
+		}
+		if reason == "" {
+			if err := o.apply(name, args); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason != "" {
+			for _, key := range keys {
+				o.entries[key] = &overlayEntry{tainted: reason}
+			}
+		}
+	}
+}
+
+// flush queues the collected commands to the pipeline of the transaction.
+func (o *overlay) flush(pipe redis.Pipeliner) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cmds, _ := o.writer.Exec()
+	for _, cmd := range append(o.cmds, cmds...) {
+		_ = pipe.Process(cmd)
+	}
+}
+
+func (o *overlay) entry(key string) *overlayEntry {
+	e, ok := o.entries[key]
+	if !ok {
+		e = &overlayEntry{}
+		o.entries[key] = e
+	}
+	return e
+}
+
+// write returns the entry of the key to write the value of the kind.
+// The value of the other type can not be written in the same way as the server.
+func (o *overlay) write(key string, kind string) (*overlayEntry, error) {
+	current, err := o.kind(key)
+	if err != nil {
+		return nil, err
+	}
+	if current != "none" && current != kind {
+		return nil, errWrongType
+	}
+	e := o.entry(key)
+	if current == "none" {
+		*e = overlayEntry{deleted: true, ttl: durationPointer(-1)}
+	}
+	e.kind = kind
+	return e, nil
+}
+
+// read returns the entry of the key holding the value of the kind, or nil if the key is not written.
+func (o *overlay) read(key string, kind string) (*overlayEntry, error) {
+	e := o.entries[key]
+	if e == nil {
+		return nil, nil
+	}
+	if e.tainted != "" {
+		return nil, &OverlayError{Key: key, Reason: e.tainted}
+	}
+	if e.kind == "" || e.kind == kind {
+		return e, nil
+	}
+	exists, err := o.exists(key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errWrongType
+	}
+	// the value of the other type is emptied.
+	return &overlayEntry{deleted: true}, nil
+}
+
+func (o *overlay) hash(key string) (map[string]string, error) {
+	e, err := o.read(key, "hash")
+	if err != nil {
+		return nil, err
+	}
+	merged := map[string]string{}
+	if e == nil || !e.deleted {
+		base, err := o.base.HGetAll(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		merged = base
+	}
+	if e != nil {
+		for field, value := range e.fields {
+			if value == nil {
+				delete(merged, field)
+			} else {
+				merged[field] = *value
+			}
+		}
+	}
+	return merged, nil
+}
+
+func (o *overlay) get(key string) (string, error) {
+	e, err := o.read(key, "string")
+	if err != nil {
+		return "", err
+	}
+	if e != nil && e.value != nil {
+		return *e.value, nil
+	}
+	if e != nil && e.deleted {
+		return "", redis.Nil
+	}
+	return o.base.Get(key).Result()
+}
+
+func (o *overlay) exists(key string) (bool, error) {
+	e := o.entries[key]
+	if e == nil {
+		n, err := o.base.Exists(key).Result()
+		return n > 0, err
+	}
+	if e.tainted != "" {
+		return false, &OverlayError{Key: key, Reason: e.tainted}
+	}
+	switch e.kind {
+	case "string":
+		return e.value != nil || !e.deleted, nil
+	case "hash":
+		hash, err := o.hash(key)
+		return len(hash) > 0, err
+	}
+	if e.deleted {
+		return false, nil
+	}
+	n, err := o.base.Exists(key).Result()
+	return n > 0, err
+}
+
+// kind returns the type of the value in the same way as TYPE.
+func (o *overlay) kind(key string) (string, error) {
+	e := o.entries[key]
+	if e == nil || e.tainted == "" && e.kind == "" && !e.deleted {
+		return o.base.Type(key).Result()
+	}
+	exists, err := o.exists(key)
+	if err != nil || !exists {
+		return "none", err
+	}
+	return e.kind, nil
+}
+
+// ttl returns the time to live in the precision of TTL or PTTL. It is -1 without the expiration and -2 if the key does not exist.
+func (o *overlay) ttl(key string, precision time.Duration) (time.Duration, error) {
+	exists, err := o.exists(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return -2 * precision, nil
+	}
+	if e := o.entries[key]; e != nil && e.ttl != nil {
+		if *e.ttl < 0 {
+			return -precision, nil
+		}
+		return e.ttl.Round(precision), nil
+	}
+	var ttl time.Duration
+	if precision == time.Second {
+		ttl, err = o.base.TTL(key).Result()
+	} else {
+		ttl, err = o.base.PTTL(key).Result()
+	}
+	// the key is created in the transaction.
+	if ttl == -2*precision {
+		return -precision, err
+	}
+	return ttl, err
+}
+
+// ------------------------------------
+// Writes
+// ------------------------------------
+
+// apply applies the command to the entries. The keys of the command are tainted if it returns the error.
+func (o *overlay) apply(name string, args []interface{}) error {
+	key := formatValue(args[1])
+	switch name {
+	case "set":
+		return o.applySet(key, args[2:])
+	case "setnx":
+		if len(args) != 3 {
+			return errArgs(name)
+		}
+		return o.applySet(key, []interface{}{args[2], "nx"})
+	case "getset":
+		if len(args) != 3 {
+			return errArgs(name)
+		}
+		if _, err := o.write(key, "string"); err != nil {
+			return err
+		}
+		return o.applySet(key, args[2:])
+	case "mset", "msetnx":
+		if len(args)%2 == 0 {
+			return errArgs(name)
+		}
+		if name == "msetnx" {
+			for i := 1; i < len(args); i += 2 {
+				exists, err := o.exists(formatValue(args[i]))
+				if err != nil || exists {
+					return err
+				}
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := o.applySet(formatValue(args[i]), args[i+1:i+2]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "append":
+		if len(args) != 3 {
+			return errArgs(name)
+		}
+		e, err := o.write(key, "string")
+		if err != nil {
+			return err
+		}
+		current, err := o.get(key)
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		e.value = stringPointer(current + formatValue(args[2]))
+		return nil
+	case "incr", "decr", "incrby", "decrby":
+		delta := int64(1)
+		if name == "incrby" || name == "decrby" {
+			if len(args) != 3 {
+				return errArgs(name)
+			}
+			n, err := strconv.ParseInt(formatValue(args[2]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			delta = n
+		} else if len(args) != 2 {
+			return errArgs(name)
+		}
+		if strings.HasPrefix(name, "decr") {
+			delta = -delta
+		}
+		return o.incrBy(key, delta)
+	case "del", "unlink":
+		for _, arg := range args[1:] {
+			o.entries[formatValue(arg)] = &overlayEntry{deleted: true, ttl: durationPointer(-1)}
+		}
+		return nil
+	case "expire", "pexpire", "expireat", "pexpireat":
+		if len(args) != 3 {
+			return errArgs(name)
+		}
+		n, err := strconv.ParseInt(formatValue(args[2]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		var ttl time.Duration
+		switch name {
+		case "expire":
+			ttl = time.Duration(n) * time.Second
+		case "pexpire":
+			ttl = time.Duration(n) * time.Millisecond
+		case "expireat":
+			ttl = time.Until(time.Unix(n, 0))
+		case "pexpireat":
+			ttl = time.Until(time.Unix(0, n*int64(time.Millisecond)))
+		}
+		return o.expire(key, ttl)
+	case "persist":
+		if len(args) != 2 {
+			return errArgs(name)
+		}
+		exists, err := o.exists(key)
+		if err != nil || !exists {
+			return err
+		}
+		o.entry(key).ttl = durationPointer(-1)
+		return nil
+	case "hset", "hmset", "hsetnx":
+		if len(args) < 4 || len(args)%2 != 0 || name == "hsetnx" && len(args) != 4 {
+			return errArgs(name)
+		}
+		e, err := o.write(key, "hash")
+		if err != nil {
+			return err
+		}
+		if name == "hsetnx" {
+			hash, err := o.hash(key)
+			if err != nil {
+				return err
+			}
+			if _, ok := hash[formatValue(args[2])]; ok {
+				return nil
+			}
+		}
+		for i := 2; i < len(args); i += 2 {
+			e.field(formatValue(args[i]), stringPointer(formatValue(args[i+1])))
+		}
+		return nil
+	case "hdel":
+		if len(args) < 3 {
+			return errArgs(name)
+		}
+		e, err := o.write(key, "hash")
+		if err != nil {
+			return err
+		}
+		for _, arg := range args[2:] {
+			e.field(formatValue(arg), nil)
+		}
+		return nil
+	case "hincrby":
+		if len(args) != 4 {
+			return errArgs(name)
+		}
+		delta, err := strconv.ParseInt(formatValue(args[3]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		e, err := o.write(key, "hash")
+		if err != nil {
+			return err
+		}
+		hash, err := o.hash(key)
+		if err != nil {
+			return err
+		}
+		field := formatValue(args[2])
+		var n int64
+		if current, ok := hash[field]; ok {
+			if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+				return errNotInteger
+			}
+		}
+		e.field(field, stringPointer(strconv.FormatInt(n+delta, 10)))
+		return nil
+	}
+	return fmt.Errorf("%s is not supported", strings.ToUpper(name))
+}
+
+// applySet applies SET with the options.
+func (o *overlay) applySet(key string, args []interface{}) error {
+	if len(args) == 0 {
+		return errArgs("set")
+	}
+	// SET discards the expiration unless KEEPTTL is specified.
+	ttl := durationPointer(-1)
+	var nx, xx bool
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(formatValue(args[i])); option {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			ttl = nil
+			if e := o.entries[key]; e != nil {
+				ttl = e.ttl
+			}
+		case "ex", "px":
+			i++
+			if i >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(formatValue(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				return errSyntax
+			}
+			unit := time.Second
+			if option == "px" {
+				unit = time.Millisecond
+			}
+			ttl = durationPointer(time.Duration(n) * unit)
+		default:
+			return errSyntax
+		}
+	}
+	if nx || xx {
+		exists, err := o.exists(key)
+		if err != nil {
+			return err
+		}
+		if nx && exists || xx && !exists {
+			return nil
+		}
+	}
+	o.entries[key] = &overlayEntry{deleted: true, kind: "string", value: stringPointer(formatValue(args[0])), ttl: ttl}
+	return nil
+}
+
+func (o *overlay) incrBy(key string, delta int64) error {
+	e, err := o.write(key, "string")
+	if err != nil {
+		return err
+	}
+	current, err := o.get(key)
+	if err == redis.Nil {
+		current, err = "0", nil
+	}
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(current, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	e.value = stringPointer(strconv.FormatInt(n+delta, 10))
+	return nil
+}
+
+// expire deletes the key if the ttl is not positive in the same way as the server.
+func (o *overlay) expire(key string, ttl time.Duration) error {
+	exists, err := o.exists(key)
+	if err != nil || !exists {
+		return err
+	}
+	if ttl <= 0 {
+		o.entries[key] = &overlayEntry{deleted: true, ttl: durationPointer(-1)}
+		return nil
+	}
+	o.entry(key).ttl = durationPointer(ttl)
+	return nil
+}
+
+func (e *overlayEntry) field(field string, value *string) {
+	if e.fields == nil {
+		e.fields = map[string]*string{}
+	}
+	e.fields[field] = value
+}
+
+func errArgs(name string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", name)
+}
+
+// formatValue formats the value in the same way as the arguments of the command.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case encoding.BinaryMarshaler:
+		data, err := v.MarshalBinary()
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
+
+func durationPointer(value time.Duration) *time.Duration {
+	return &value
+}
+
+// ------------------------------------
+// Reader
+// ------------------------------------
+
+// overlayBase is the client or the watching connection read by the overlay.
+type overlayBase interface {
+	redis.Cmdable
+	Process(cmd redis.Cmder) error
+}
+
+// overlayReader reads the values merged with the writes in the overlay.
+// The other commands return OverlayError if they read the written keys, or if the keys are unknown and any key is written.
+type overlayReader struct {
+	// guarded sends the commands the overlay does not merge to the server after the check.
+	redis.Cmdable
+	overlay *overlay
+}
+
+// the commands which read no key.
+var overlayKeyless = map[string]bool{
+	"ping": true, "echo": true, "time": true, "info": true, "config": true, "client": true, "command": true,
+	"script": true, "cluster": true, "slowlog": true, "lastsave": true,
+}
+
+// the commands whose keys are not the arguments given by keysOf, or which read the keys matched with the pattern.
+var overlayUnknownKeys = map[string]bool{
+	"keys": true, "scan": true, "randomkey": true, "dbsize": true, "object": true, "memory": true, "debug": true,
+	"xread": true, "xreadgroup": true, "sort": true, "bitop": true, "migrate": true, "wait": true,
+}
+
+func newOverlayReader(o *overlay) *overlayReader {
+	r := &overlayReader{overlay: o}
+	guarded := detached.WithContext(context.Background())
+	guarded.WrapProcess(func(_ func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			if err := r.unmerged(cmd); err != nil {
+				return failed(cmd, err)
+			}
+			return o.base.Process(cmd)
+		}
+	})
+	guarded.WrapProcessPipeline(func(_ func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			for _, cmd := range cmds {
+				if err := r.unmerged(cmd); err != nil {
+					for _, cmd := range cmds {
+						_ = failed(cmd, err)
+					}
+					return err
+				}
+			}
+			_, err := o.base.Pipelined(func(pipe redis.Pipeliner) error {
+				for _, cmd := range cmds {
+					_ = pipe.Process(cmd)
+				}
+				return nil
+			})
+			return err
+		}
+	})
+	r.Cmdable = guarded
+	return r
+}
+
+// unmerged returns OverlayError if the command reads the written keys.
+func (r *overlayReader) unmerged(cmd redis.Cmder) error {
+	args := cmd.Args()
+	name := strings.ToLower(formatValue(args[0]))
+	if overlayKeyless[name] {
+		return nil
+	}
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	reason := fmt.Sprintf("%s is not merged with the writes", strings.ToUpper(name))
+	if overlayUnknownKeys[name] || len(args) < 2 {
+		if len(r.overlay.entries) > 0 {
+			return &OverlayError{Reason: reason}
+		}
+		return nil
+	}
+	for _, key := range keysOf(args) {
+		if e := r.overlay.entries[key]; e != nil {
+			if e.tainted != "" {
+				reason = e.tainted
+			}
+			return &OverlayError{Key: key, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// failed sets the error to the command of any type. The client never connects because its dialer returns the error.
+func failed(cmd redis.Cmder, err error) error {
+	client := redis.NewClient(&redis.Options{
+		Dialer: func() (net.Conn, error) {
+			return nil, err
+		},
+		IdleTimeout: -1,
+	})
+	defer client.Close()
+	return client.Process(cmd)
+}
+
+func (r *overlayReader) Get(key string) *redis.StringCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	return redis.NewStringResult(r.overlay.get(key))
+}
+
+func (r *overlayReader) MGet(keys ...string) *redis.SliceCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		value, err := r.overlay.get(key)
+		switch err {
+		case nil:
+			values[i] = value
+		case redis.Nil, errWrongType:
+		default:
+			return redis.NewSliceResult(nil, err)
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func (r *overlayReader) StrLen(key string) *redis.IntCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	value, err := r.overlay.get(key)
+	if err == redis.Nil {
+		return redis.NewIntResult(0, nil)
+	}
+	return redis.NewIntResult(int64(len(value)), err)
+}
+
+func (r *overlayReader) Exists(keys ...string) *redis.IntCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		exists, err := r.overlay.exists(key)
+		if err != nil {
+			return redis.NewIntResult(0, err)
+		}
+		if exists {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (r *overlayReader) Type(key string) *redis.StatusCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	return redis.NewStatusResult(r.overlay.kind(key))
+}
+
+func (r *overlayReader) TTL(key string) *redis.DurationCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	return redis.NewDurationResult(r.overlay.ttl(key, time.Second))
+}
+
+func (r *overlayReader) PTTL(key string) *redis.DurationCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	return redis.NewDurationResult(r.overlay.ttl(key, time.Millisecond))
+}
+
+func (r *overlayReader) HGet(key, field string) *redis.StringCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	if r.overlay.entries[key] == nil {
+		return r.overlay.base.HGet(key, field)
+	}
+	hash, err := r.overlay.hash(key)
+	if err != nil {
+		return redis.NewStringResult("", err)
+	}
+	value, ok := hash[field]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(value, nil)
+}
+
+func (r *overlayReader) HMGet(key string, fields ...string) *redis.SliceCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	if r.overlay.entries[key] == nil {
+		return r.overlay.base.HMGet(key, fields...)
+	}
+	hash, err := r.overlay.hash(key)
+	if err != nil {
+		return redis.NewSliceResult(nil, err)
+	}
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if value, ok := hash[field]; ok {
+			values[i] = value
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func (r *overlayReader) HGetAll(key string) *redis.StringStringMapCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	return redis.NewStringStringMapResult(r.overlay.hash(key))
+}
+
+func (r *overlayReader) HExists(key, field string) *redis.BoolCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	hash, err := r.overlay.hash(key)
+	_, ok := hash[field]
+	return redis.NewBoolResult(ok, err)
+}
+
+func (r *overlayReader) HLen(key string) *redis.IntCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	hash, err := r.overlay.hash(key)
+	return redis.NewIntResult(int64(len(hash)), err)
+}
+
+func (r *overlayReader) HKeys(key string) *redis.StringSliceCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	hash, err := r.overlay.hash(key)
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	return redis.NewStringSliceResult(fields, err)
+}
+
+func (r *overlayReader) HVals(key string) *redis.StringSliceCmd {
+	r.overlay.lock()
+	defer r.overlay.mu.Unlock()
+	hash, err := r.overlay.hash(key)
+	values := make([]string, 0, len(hash))
+	for _, value := range hash {
+		values = append(values, value)
+	}
+	return redis.NewStringSliceResult(values, err)
+}
@@ -2,7 +2,11 @@ package gotx
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/knocknote/gotx"
 
@@ -21,49 +25,277 @@ func contextKey(shardKey string) contextTransactionKey {
 	return contextTransactionKey(fmt.Sprintf("current_%s_tx", shardKey))
 }
 
+// transactionKey returns the error instead of the panic if the shard key can not be determined.
+func transactionKey(ctx context.Context, shardKeyProvider ShardKeyProvider) (contextTransactionKey, error) {
+	shardKey, err := gotx.ResolveShardKey(ctx, shardKeyProvider)
+	if err != nil {
+		return "", err
+	}
+	return contextKey(shardKey), nil
+}
+
+// currentTransaction returns nil if no transaction exists.
+func currentTransaction(ctx context.Context, shardKeyProvider ShardKeyProvider) (*transaction, error) {
+	key, err := transactionKey(ctx, shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := ctx.Value(key).(*transaction)
+	return current, nil
+}
+
 // --------------------------------
 // Connection
 // --------------------------------
 type ConnectionProvider interface {
-	CurrentConnection(ctx context.Context) *redis.Client
+	CurrentConnection(ctx context.Context) redis.UniversalClient
+}
+
+// ConnectionResolver is implemented by the ConnectionProvider which can fail to determine the connection.
+type ConnectionResolver interface {
+	ResolveConnection(ctx context.Context) (redis.UniversalClient, error)
+}
+
+// connectionTracker counts the transactions running on the connection.
+type connectionTracker interface {
+	acquire(ctx context.Context) (redis.UniversalClient, func(), error)
+}
+
+// acquireConnection resolves the connection of the transaction. release must be called when the transaction completes.
+func acquireConnection(ctx context.Context, provider ConnectionProvider) (conn redis.UniversalClient, release func(), err error) {
+	if tracker, ok := provider.(connectionTracker); ok {
+		return tracker.acquire(ctx)
+	}
+	conn, err = ResolveConnection(ctx, provider)
+	return conn, func() {}, err
+}
+
+// ResolveConnection returns the error instead of the panic if the provider implements ConnectionResolver.
+func ResolveConnection(ctx context.Context, provider ConnectionProvider) (redis.UniversalClient, error) {
+	if resolver, ok := provider.(ConnectionResolver); ok {
+		return resolver.ResolveConnection(ctx)
+	}
+	return provider.CurrentConnection(ctx), nil
 }
 
 // get redis client from field
 type DefaultConnectionProvider struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
-func NewDefaultConnectionProvider(client *redis.Client) ConnectionProvider {
+func NewDefaultConnectionProvider(client redis.UniversalClient) ConnectionProvider {
 	return &DefaultConnectionProvider{
 		client: client,
 	}
 }
 
-func (p *DefaultConnectionProvider) CurrentConnection(_ context.Context) *redis.Client {
+func (p *DefaultConnectionProvider) CurrentConnection(_ context.Context) redis.UniversalClient {
 	return p.client
 }
 
+// Topology is the connections and the router of the sharding.
+type Topology struct {
+	DB []redis.UniversalClient
+	// the router must return the index of DB.
+	Router gotx.ShardRouter
+}
+
 // get db by hash slot
 type ShardingConnectionProvider struct {
-	db               []*redis.Client
-	hashSlot         []uint32
+	mu               sync.Mutex
+	topology         atomic.Value
 	shardKeyProvider ShardKeyProvider
-	maxSlot          uint32
+	onReload         gotx.ReloadHook
+	// the number of the transactions running on each connection. the removed connections are closed after they complete.
+	inFlightMu sync.Mutex
+	inFlight   map[redis.UniversalClient]int
 }
 
+// NewShardingConnectionProvider panics with ShardingConfigError if db is empty or maxSlot is less than the number of db.
 func NewShardingConnectionProvider(db []*redis.Client, maxSlot uint32, shardKeyProvider ShardKeyProvider) ConnectionProvider {
-	return &ShardingConnectionProvider{
-		db:               db,
+	return NewShardingConnectionProviderUniversal(universalClients(db), maxSlot, shardKeyProvider)
+}
+
+// NewShardingConnectionProviderUniversal accepts the cluster or failover clients as db.
+func NewShardingConnectionProviderUniversal(db []redis.UniversalClient, maxSlot uint32, shardKeyProvider ShardKeyProvider) ConnectionProvider {
+	if err := gotx.ValidateHashSlot(len(db), maxSlot); err != nil {
+		panic(err)
+	}
+	return NewShardingConnectionProviderWithRouterUniversal(db, gotx.NewHashSlotRouter(len(db), maxSlot), shardKeyProvider)
+}
+
+// the router must return the index of db.
+func NewShardingConnectionProviderWithRouter(db []*redis.Client, router gotx.ShardRouter, shardKeyProvider ShardKeyProvider) ConnectionProvider {
+	return NewShardingConnectionProviderWithRouterUniversal(universalClients(db), router, shardKeyProvider)
+}
+
+// NewShardingConnectionProviderWithRouterUniversal accepts the cluster or failover clients as db.
+func NewShardingConnectionProviderWithRouterUniversal(db []redis.UniversalClient, router gotx.ShardRouter, shardKeyProvider ShardKeyProvider) ConnectionProvider {
+	if len(db) == 0 || router == nil {
+		panic(&gotx.ShardingConfigError{Reason: "connections and router are required"})
+	}
+	p := &ShardingConnectionProvider{
 		shardKeyProvider: shardKeyProvider,
-		hashSlot:         gotx.GetHashSlotRange(len(db), maxSlot),
-		maxSlot:          maxSlot,
+		inFlight:         map[redis.UniversalClient]int{},
+	}
+	p.topology.Store(&Topology{DB: db, Router: router})
+	return p
+}
+
+// NewShardingConnectionProviderWithSlotMap returns error if the slot map is invalid or the number of the shards is not the same as db.
+func NewShardingConnectionProviderWithSlotMap(db []*redis.Client, slotMap *gotx.SlotMap, shardKeyProvider ShardKeyProvider) (ConnectionProvider, error) {
+	return NewShardingConnectionProviderWithSlotMapUniversal(universalClients(db), slotMap, shardKeyProvider)
+}
+
+// NewShardingConnectionProviderWithSlotMapUniversal accepts the cluster or failover clients as db.
+func NewShardingConnectionProviderWithSlotMapUniversal(db []redis.UniversalClient, slotMap *gotx.SlotMap, shardKeyProvider ShardKeyProvider) (ConnectionProvider, error) {
+	if slotMap.Size() != len(db) {
+		return nil, &gotx.SlotMapError{Reason: fmt.Sprintf("%d shards are listed for %d connections", slotMap.Size(), len(db))}
+	}
+	router, err := slotMap.Router()
+	if err != nil {
+		return nil, err
+	}
+	return NewShardingConnectionProviderWithRouterUniversal(db, router, shardKeyProvider), nil
+}
+
+func universalClients(db []*redis.Client) []redis.UniversalClient {
+	clients := make([]redis.UniversalClient, len(db))
+	for i, client := range db {
+		clients[i] = client
+	}
+	return clients
+}
+
+// CurrentConnection panics if the shard can not be determined. Use ResolveConnection to get the error.
+func (p *ShardingConnectionProvider) CurrentConnection(ctx context.Context) redis.UniversalClient {
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return conn
+}
+
+func (p *ShardingConnectionProvider) ResolveConnection(ctx context.Context) (redis.UniversalClient, error) {
+	topology := p.topology.Load().(*Topology)
+	shardKey, err := gotx.ResolveShardKey(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	index := topology.Router.ShardIndex([]byte(shardKey))
+	if index < 0 || index >= len(topology.DB) {
+		return nil, &gotx.ShardRoutingError{ShardKey: shardKey, Index: index, Size: len(topology.DB)}
 	}
+	return topology.DB[index], nil
 }
 
-func (p *ShardingConnectionProvider) CurrentConnection(ctx context.Context) *redis.Client {
-	shardKey := p.shardKeyProvider(ctx)
-	index := gotx.GetIndexByHash(p.hashSlot, []byte(shardKey), p.maxSlot)
-	return p.db[index]
+// OnReload sets the hook called when the reload completes.
+func (p *ShardingConnectionProvider) OnReload(hook gotx.ReloadHook) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onReload = hook
+}
+
+// Reload swaps the topology atomically. The transactions already begun keep using the original connection.
+// The connections removed from the topology are closed after all the transactions on them complete or the context is done.
+func (p *ShardingConnectionProvider) Reload(ctx context.Context, topology Topology) error {
+	if len(topology.DB) == 0 || topology.Router == nil {
+		return errors.New("connections and router are required for the topology")
+	}
+	start := time.Now()
+	p.mu.Lock()
+	p.inFlightMu.Lock()
+	current := p.topology.Load().(*Topology)
+	p.topology.Store(&topology)
+	p.inFlightMu.Unlock()
+	onReload := p.onReload
+	p.mu.Unlock()
+
+	event := gotx.ReloadEvent{}
+	for _, db := range topology.DB {
+		if !containsConnection(current.DB, db) {
+			event.Added++
+		}
+	}
+	for _, db := range current.DB {
+		if containsConnection(topology.DB, db) {
+			continue
+		}
+		event.Removed++
+		if err := p.drain(ctx, db); err != nil && event.Err == nil {
+			event.Err = err
+		}
+	}
+	event.Elapsed = time.Since(start)
+	if onReload != nil {
+		onReload(event)
+	}
+	return event.Err
+}
+
+// acquire resolves the connection and counts the transaction on it until release is called.
+func (p *ShardingConnectionProvider) acquire(ctx context.Context) (redis.UniversalClient, func(), error) {
+	// the topology is not swapped between resolving and counting.
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	conn, err := p.ResolveConnection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.inFlight[conn]++
+	return conn, func() {
+		p.inFlightMu.Lock()
+		defer p.inFlightMu.Unlock()
+		if p.inFlight[conn]--; p.inFlight[conn] == 0 {
+			delete(p.inFlight, conn)
+		}
+	}, nil
+}
+
+func (p *ShardingConnectionProvider) running(db redis.UniversalClient) int {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	return p.inFlight[db]
+}
+
+var drainInterval = 10 * time.Millisecond
+
+// drain waits for the transactions on the db to complete and closes the db.
+// The pipelined transaction holds no connection of the pool until EXEC, so the transactions are counted by the provider.
+func (p *ShardingConnectionProvider) drain(ctx context.Context, db redis.UniversalClient) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil && (p.running(db) > 0 || inUse(db) > 0) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if closeErr := db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// inUse returns the connections of the pool used by the commands outside the transaction.
+func inUse(client redis.UniversalClient) int {
+	pooled, ok := client.(interface{ PoolStats() *redis.PoolStats })
+	if !ok {
+		return 0
+	}
+	stats := pooled.PoolStats()
+	return int(stats.TotalConns - stats.IdleConns)
+}
+
+func containsConnection(dbs []redis.UniversalClient, target redis.UniversalClient) bool {
+	for _, db := range dbs {
+		if db == target {
+			return true
+		}
+	}
+	return false
 }
 
 // ------------------------------------
@@ -73,6 +305,20 @@ type ClientProvider interface {
 	CurrentClient(ctx context.Context) (reader redis.Cmdable, writer redis.Cmdable)
 }
 
+// ClientResolver is implemented by the ClientProvider which can fail to determine the client.
+type ClientResolver interface {
+	ResolveClient(ctx context.Context) (reader redis.Cmdable, writer redis.Cmdable, err error)
+}
+
+// ResolveClient returns the error instead of the panic if the provider implements ClientResolver.
+func ResolveClient(ctx context.Context, provider ClientProvider) (reader redis.Cmdable, writer redis.Cmdable, err error) {
+	if resolver, ok := provider.(ClientResolver); ok {
+		return resolver.ResolveClient(ctx)
+	}
+	reader, writer = provider.CurrentClient(ctx)
+	return reader, writer, nil
+}
+
 type DefaultClientProvider struct {
 	shardKeyProvider   ShardKeyProvider
 	connectionProvider ConnectionProvider
@@ -89,18 +335,91 @@ func NewShardingDefaultClientProvider(connectionProvider ConnectionProvider, sha
 	}
 }
 
+// CurrentClient panics if the shard can not be determined. Use ResolveClient to get the error.
 func (p *DefaultClientProvider) CurrentClient(ctx context.Context) (reader redis.Cmdable, writer redis.Cmdable) {
-	client := p.connectionProvider.CurrentConnection(ctx)
-	transaction := ctx.Value(contextKey(p.shardKeyProvider(ctx)))
-	if transaction == nil {
-		return client, client
+	reader, writer, err := p.ResolveClient(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return reader, writer
+}
+
+// ResolveClient returns ShardKeyNotFoundError or ShardRoutingError if the shard can not be determined.
+func (p *DefaultClientProvider) ResolveClient(ctx context.Context) (reader redis.Cmdable, writer redis.Cmdable, err error) {
+	current, err := currentTransaction(ctx, p.shardKeyProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the reader sees the pending writes with OptionOverlay.
+	if current != nil && current.reader != nil {
+		return current.reader, current.Pipeliner, nil
+	}
+	// the reader reads the real values on the watching connection before MULTI.
+	if current != nil && current.tx != nil {
+		return current.tx, current.Pipeliner, nil
+	}
+	client, err := ResolveConnection(ctx, p.connectionProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if current == nil {
+		return client, client, nil
 	}
-	return client, transaction.(redis.Cmdable)
+	return client, current.Pipeliner, nil
+}
+
+// Watch watches the keys dynamically in the transaction begun with OptionWatch.
+func (p *DefaultClientProvider) Watch(ctx context.Context, keys ...string) error {
+	current, err := currentTransaction(ctx, p.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.tx == nil {
+		return ErrNotWatching
+	}
+	return current.tx.Watch(keys...).Err()
+}
+
+// OnExec registers fn called with the results of the commands queued in the transaction after EXEC succeeds.
+// fn is called before the AfterCommit synchronizations. It is not called if the transaction is rolled back.
+func (p *DefaultClientProvider) OnExec(ctx context.Context, fn func(cmds []redis.Cmder)) error {
+	current, err := currentTransaction(ctx, p.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return gotx.NewMandatoryError()
+	}
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	current.onExec = append(current.onExec, fn)
+	return nil
 }
 
 // ------------------------------------
 // Transactor
 // ------------------------------------
+
+// transaction stored in the context.
+type transaction struct {
+	redis.Pipeliner
+	status *gotx.DefaultTransactionStatus
+	// the connection watching the keys. it is nil without OptionWatch.
+	tx *redis.Tx
+	// the reader merged with the pending writes. it is nil without OptionOverlay.
+	reader redis.Cmdable
+	// the transaction of the ScriptTransactor.
+	scripting bool
+
+	mu sync.Mutex
+	// pipelines of the other connections executed after the commit.
+	secondaries map[redis.UniversalClient]redis.Pipeliner
+	// callbacks receiving the results of EXEC.
+	onExec []func(cmds []redis.Cmder)
+	// checked in the script of the ScriptTransactor.
+	preconditions []Precondition
+}
+
 type Transactor struct {
 	shardKeyProvider   ShardKeyProvider
 	connectionProvider ConnectionProvider
@@ -118,9 +437,66 @@ func NewShardingTransactor(connectionProvider ConnectionProvider, shardKeyProvid
 }
 
 func (t *Transactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
-	if ctx.Value(contextKey(t.shardKeyProvider(ctx))) != nil {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *Transactor) Supports(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil {
 		return fn(ctx)
 	}
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *Transactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return gotx.NewMandatoryError()
+	}
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *Transactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return gotx.NewNeverError()
+	}
+	return fn(ctx)
+}
+
+func (t *Transactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	// the client provider returns the raw client as writer if the transaction is nil.
+	return fn(gotx.WithStatus(context.WithValue(ctx, key, nil), nil))
+}
+
+func (t *Transactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "redis"}
+	}
 	return t.RequiresNew(ctx, fn, options...)
 }
 
@@ -129,14 +505,91 @@ func (t *Transactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, o
 	for _, opt := range options {
 		opt.Apply(&config)
 	}
-	//TODO support optimistic locking if needed.
-	redisClient := t.connectionProvider.CurrentConnection(ctx)
-	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
-		err := fn(context.WithValue(ctx, contextKey(t.shardKeyProvider(ctx)), pipe))
-		if err != nil || config.RollbackOnly {
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	redisClient, release, err := acquireConnection(ctx, t.connectionProvider)
+	if err != nil {
+		return err
+	}
+	defer release()
+	vendor := vendorOptionOf(config)
+	if !vendor.watch {
+		return t.execute(ctx, key, fn, config, redisClient, nil)
+	}
+	if len(vendor.watchKeys) == 0 && isCluster(redisClient) {
+		return ErrWatchKeysRequired
+	}
+	// optimistic locking
+	for attempt := 1; ; attempt++ {
+		err = redisClient.Watch(func(tx *redis.Tx) error {
+			return t.execute(ctx, key, fn, config, redisClient, tx)
+		}, vendor.watchKeys...)
+		if err != redis.TxFailedErr || attempt >= vendor.maxAttempts() {
+			return err
+		}
+	}
+}
+
+func (t *Transactor) execute(ctx context.Context, key contextTransactionKey, fn gotx.DoInTransaction, config gotx.Config, client redis.UniversalClient, tx *redis.Tx) error {
+	status := gotx.NewTransactionStatus("redis", true, config)
+	// the keys of the cluster client are checked before sending.
+	pipelined := withSlotCheck(client).TxPipelined
+	var base overlayBase = client
+	if tx != nil {
+		if isCluster(client) {
+			tx.WrapProcessPipeline(slotCheck)
+		}
+		pipelined = tx.TxPipelined
+		base = tx
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			status.TriggerAfterRollback(ctx)
+			panic(p)
+		}
+	}()
+	var fnErr error
+	var current *transaction
+	var o *overlay
+	cmds, err := pipelined(func(pipe redis.Pipeliner) error {
+		current = &transaction{Pipeliner: pipe, status: status, tx: tx}
+		if vendorOptionOf(config).overlay {
+			o = newOverlay(base)
+			current.Pipeliner = o.writer
+			current.reader = newOverlayReader(o)
+		}
+		txCtx := gotx.WithStatus(context.WithValue(ctx, key, current), status)
+		fnErr = fn(txCtx)
+		if config.ShouldRollback(fnErr) {
 			_ = pipe.Discard()
+			return fnErr
 		}
-		return err
+		if status.IsRollbackOnly() {
+			_ = pipe.Discard()
+			return nil
+		}
+		if err := status.TriggerBeforeCommit(txCtx); err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+		if o != nil {
+			o.flush(pipe)
+		}
+		return nil
 	})
-	return err
+	if err != nil || status.IsRollbackOnly() {
+		status.TriggerAfterRollback(ctx)
+		if err != nil {
+			return err
+		}
+		return fnErr
+	}
+	for _, onExec := range current.onExec {
+		onExec(cmds)
+	}
+	status.TriggerAfterCommit(ctx)
+	// the error matched with the no rollback rule is returned after exec.
+	return fnErr
 }
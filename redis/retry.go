@@ -0,0 +1,16 @@
+package gotx
+
+import (
+	"errors"
+
+	"github.com/knocknote/gotx"
+
+	"github.com/go-redis/redis"
+)
+
+// NewRetryClassifier retries the transaction failed with redis.TxFailedErr.
+func NewRetryClassifier() gotx.RetryClassifier {
+	return gotx.RetryClassifierFunc(func(err error) bool {
+		return errors.Is(err, redis.TxFailedErr)
+	})
+}
@@ -0,0 +1,36 @@
+package gotx
+
+import (
+	"context"
+
+	"github.com/knocknote/gotx"
+
+	"github.com/go-redis/redis"
+)
+
+// ShardFunc is called with the client of each shard.
+type ShardFunc func(ctx context.Context, shard int, client redis.Cmdable) error
+
+// ShardQueryFunc returns the results of each shard.
+type ShardQueryFunc func(ctx context.Context, shard int, client redis.Cmdable) ([]interface{}, error)
+
+// Shards returns the clients of the current topology.
+func (p *ShardingConnectionProvider) Shards() []redis.UniversalClient {
+	return p.topology.Load().(*Topology).DB
+}
+
+// ForEachShard calls fn for each shard in order. It stops at the first error.
+func (p *ShardingConnectionProvider) ForEachShard(ctx context.Context, fn ShardFunc) error {
+	shards := p.Shards()
+	return gotx.ForEachShard(ctx, len(shards), func(ctx context.Context, shard int) error {
+		return fn(ctx, shard, shards[shard])
+	})
+}
+
+// ScatterGather calls fn for each shard in parallel and merges the results. config.ReadOnly is ignored.
+func (p *ShardingConnectionProvider) ScatterGather(ctx context.Context, fn ShardQueryFunc, config gotx.ScatterGatherConfig) ([]interface{}, error) {
+	shards := p.Shards()
+	return gotx.ScatterGather(ctx, len(shards), func(ctx context.Context, shard int) ([]interface{}, error) {
+		return fn(ctx, shard, shards[shard])
+	}, config)
+}
@@ -0,0 +1,397 @@
+package gotx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knocknote/gotx"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrNotScripting is returned by Expect outside the transaction of the ScriptTransactor.
+var ErrNotScripting = errors.New("redis: the transaction is not begun by ScriptTransactor")
+
+// ------------------------------------
+// Precondition
+// ------------------------------------
+
+// Precondition is checked in the script before the queued commands. The script aborts without any writes if it is not satisfied.
+type Precondition interface {
+	// Key is declared in KEYS of the script.
+	Key() string
+	// Lua returns the boolean expression of the condition. arg passes the value to the script and returns the expression referring to it.
+	Lua(arg func(value interface{}) string) string
+	String() string
+}
+
+type precondition struct {
+	key         string
+	description string
+	lua         func(arg func(value interface{}) string) string
+}
+
+func (p *precondition) Key() string {
+	return p.key
+}
+
+func (p *precondition) Lua(arg func(value interface{}) string) string {
+	return p.lua(arg)
+}
+
+func (p *precondition) String() string {
+	return p.description
+}
+
+// KeyEquals is satisfied if the string value of the key equals the value.
+func KeyEquals(key string, value interface{}) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("%s equals %s", key, formatValue(value)),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("redis.call('GET', %s) == %s", arg(key), arg(value))
+		},
+	}
+}
+
+func KeyExists(key string) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("%s exists", key),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("redis.call('EXISTS', %s) == 1", arg(key))
+		},
+	}
+}
+
+func KeyNotExists(key string) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("%s does not exist", key),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("redis.call('EXISTS', %s) == 0", arg(key))
+		},
+	}
+}
+
+// HashFieldEquals is satisfied if the value of the field of the hash equals the value.
+func HashFieldEquals(key, field string, value interface{}) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("%s.%s equals %s", key, field, formatValue(value)),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("redis.call('HGET', %s, %s) == %s", arg(key), arg(field), arg(value))
+		},
+	}
+}
+
+// ZScoreAtLeast is satisfied if the score of the member is greater than or equal to min. It is not satisfied if the member does not exist.
+func ZScoreAtLeast(key, member string, min float64) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("score of %s in %s is at least %s", member, key, formatValue(min)),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("(score(%s, %s) or -math.huge) >= tonumber(%s)", arg(key), arg(member), arg(min))
+		},
+	}
+}
+
+// ZScoreAtMost is satisfied if the score of the member is less than or equal to max. It is not satisfied if the member does not exist.
+func ZScoreAtMost(key, member string, max float64) Precondition {
+	return &precondition{
+		key:         key,
+		description: fmt.Sprintf("score of %s in %s is at most %s", member, key, formatValue(max)),
+		lua: func(arg func(value interface{}) string) string {
+			return fmt.Sprintf("(score(%s, %s) or math.huge) <= tonumber(%s)", arg(key), arg(member), arg(max))
+		},
+	}
+}
+
+// Expect checks the preconditions in the script of the ScriptTransactor.
+type Expect []Precondition
+
+func (o Expect) Apply(c *gotx.Config) {
+	current := currentVendorOption(c)
+	current.preconditions = append(current.preconditions, o...)
+}
+
+// OptionExpect declares the preconditions. They can be also declared dynamically by DefaultClientProvider.Expect in the transaction.
+func OptionExpect(preconditions ...Precondition) Expect {
+	return preconditions
+}
+
+// Expect declares the preconditions dynamically in the transaction of the ScriptTransactor.
+func (p *DefaultClientProvider) Expect(ctx context.Context, preconditions ...Precondition) error {
+	current, err := currentTransaction(ctx, p.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil || !current.scripting {
+		return ErrNotScripting
+	}
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	current.preconditions = append(current.preconditions, preconditions...)
+	return nil
+}
+
+// ------------------------------------
+// Errors
+// ------------------------------------
+
+// PreconditionFailedError is returned when the script aborts. None of the queued commands are executed.
+type PreconditionFailedError struct {
+	Precondition Precondition
+}
+
+func (e *PreconditionFailedError) Error() string {
+	return fmt.Sprintf("redis: precondition failed: %s", e.Precondition)
+}
+
+// ScriptCommandError is returned when the queued command fails in the script.
+// Like EXEC, the other commands are executed regardless of the failure and the transaction is committed.
+type ScriptCommandError struct {
+	Index int
+	Args  []interface{}
+	Err   error
+}
+
+func (e *ScriptCommandError) Error() string {
+	return fmt.Sprintf("redis: command %d %v failed in the script: %v", e.Index, e.Args, e.Err)
+}
+
+func (e *ScriptCommandError) Unwrap() error {
+	return e.Err
+}
+
+// ------------------------------------
+// Script
+// ------------------------------------
+
+// the commands are passed after the arguments of the preconditions as the number of the arguments followed by the arguments.
+const scriptCommands = `local results = {1}
+local i = %d
+while i <= #ARGV do
+  local n = tonumber(ARGV[i])
+  results[#results + 1] = redis.pcall(unpack(ARGV, i + 1, i + n))
+  i = i + n + 1
+end
+return results
+`
+
+const scriptHelpers = `local function score(key, member)
+  local s = redis.call('ZSCORE', key, member)
+  if s then
+    return tonumber(s)
+  end
+  return nil
+end
+`
+
+// scriptCache keeps the scripts compiled for each combination of the preconditions.
+type scriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]*redis.Script
+}
+
+func (c *scriptCache) script(src string) *redis.Script {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if script, ok := c.scripts[src]; ok {
+		return script
+	}
+	if c.scripts == nil {
+		c.scripts = map[string]*redis.Script{}
+	}
+	script := redis.NewScript(src)
+	c.scripts[src] = script
+	return script
+}
+
+// run compiles the preconditions and the commands into the script and runs it by EVALSHA, or EVAL if the script is not loaded.
+// The keys of the cluster client are checked before sending.
+func (c *scriptCache) run(client redis.UniversalClient, preconditions []Precondition, cmds []redis.Cmder) ([]redis.Cmder, error) {
+	var src strings.Builder
+	var keys []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "ARGV[" + strconv.Itoa(len(args)) + "]"
+	}
+	src.WriteString(scriptHelpers)
+	for i, p := range preconditions {
+		keys = append(keys, p.Key())
+		fmt.Fprintf(&src, "if not (%s) then\n  return {0, %d}\nend\n", p.Lua(arg), i+1)
+	}
+	fmt.Fprintf(&src, scriptCommands, len(args)+1)
+	for _, cmd := range cmds {
+		cmdArgs := cmd.Args()
+		keys = append(keys, keysOf(cmdArgs)...)
+		args = append(args, len(cmdArgs))
+		args = append(args, cmdArgs...)
+	}
+	if isCluster(client) {
+		if err := checkSlot(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := c.script(src.String()).Run(client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := value.([]interface{})
+	if !ok || len(reply) == 0 {
+		return nil, fmt.Errorf("redis: unexpected reply of the script %v", value)
+	}
+	if status, _ := reply[0].(int64); status == 0 {
+		var index int64
+		if len(reply) >= 2 {
+			index, _ = reply[1].(int64)
+		}
+		if index < 1 || index > int64(len(preconditions)) {
+			return nil, fmt.Errorf("redis: unexpected reply of the script %v", value)
+		}
+		return nil, &PreconditionFailedError{Precondition: preconditions[index-1]}
+	}
+	if len(reply) != len(cmds)+1 {
+		return nil, fmt.Errorf("redis: unexpected reply of the script %v", value)
+	}
+	results := make([]redis.Cmder, len(cmds))
+	var firstErr error
+	for i, value := range reply[1:] {
+		switch v := value.(type) {
+		case nil:
+			results[i] = redis.NewCmdResult(nil, redis.Nil)
+		case error:
+			results[i] = redis.NewCmdResult(nil, v)
+			if firstErr == nil {
+				firstErr = &ScriptCommandError{Index: i, Args: cmds[i].Args(), Err: v}
+			}
+		default:
+			results[i] = redis.NewCmdResult(v, nil)
+		}
+	}
+	return results, firstErr
+}
+
+// ------------------------------------
+// Transactor
+// ------------------------------------
+
+// ScriptTransactor runs the commands queued in the transaction and the preconditions in a single Lua script instead of MULTI/EXEC.
+// The script aborts with PreconditionFailedError before any writes if the preconditions are not satisfied.
+// The results of the commands are passed to DefaultClientProvider.OnExec as *redis.Cmd.
+// The commands are collected without the connection, so any redis.UniversalClient including *redis.Ring is supported.
+type ScriptTransactor struct {
+	Transactor
+	scripts *scriptCache
+}
+
+func NewScriptTransactor(connectionProvider ConnectionProvider) gotx.Transactor {
+	return NewShardingScriptTransactor(connectionProvider, defaultShardKeyProvider)
+}
+
+func NewShardingScriptTransactor(connectionProvider ConnectionProvider, shardKeyProvider ShardKeyProvider) gotx.Transactor {
+	return &ScriptTransactor{
+		Transactor: Transactor{
+			shardKeyProvider:   shardKeyProvider,
+			connectionProvider: connectionProvider,
+		},
+		scripts: &scriptCache{},
+	}
+}
+
+func (t *ScriptTransactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	return fn(gotx.WithStatus(ctx, current.status.Join()))
+}
+
+func (t *ScriptTransactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	current, err := currentTransaction(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "redis"}
+	}
+	return t.RequiresNew(ctx, fn, options...)
+}
+
+func (t *ScriptTransactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	config := gotx.NewDefaultConfig()
+	for _, opt := range options {
+		opt.Apply(&config)
+	}
+	key, err := transactionKey(ctx, t.shardKeyProvider)
+	if err != nil {
+		return err
+	}
+	redisClient, release, err := acquireConnection(ctx, t.connectionProvider)
+	if err != nil {
+		return err
+	}
+	defer release()
+	vendor := vendorOptionOf(config)
+	status := gotx.NewTransactionStatus("redis", true, config)
+	defer func() {
+		if p := recover(); p != nil {
+			status.TriggerAfterRollback(ctx)
+			panic(p)
+		}
+	}()
+
+	// the pipeline only collects the commands.
+	pipe := newCollector()
+	current := &transaction{Pipeliner: pipe, status: status, scripting: true}
+	current.preconditions = append(current.preconditions, vendor.preconditions...)
+	var o *overlay
+	if vendor.overlay {
+		o = newOverlay(redisClient)
+		current.Pipeliner = o.writer
+		current.reader = newOverlayReader(o)
+	}
+	txCtx := gotx.WithStatus(context.WithValue(ctx, key, current), status)
+	fnErr := fn(txCtx)
+	if config.ShouldRollback(fnErr) || status.IsRollbackOnly() {
+		status.TriggerAfterRollback(ctx)
+		return fnErr
+	}
+	if err = status.TriggerBeforeCommit(txCtx); err != nil {
+		status.TriggerAfterRollback(ctx)
+		return err
+	}
+	if o != nil {
+		o.flush(pipe)
+	}
+	cmds, _ := pipe.Exec()
+	if len(cmds) == 0 && len(current.preconditions) == 0 {
+		status.TriggerAfterCommit(ctx)
+		return fnErr
+	}
+	results, err := t.scripts.run(redisClient, current.preconditions, cmds)
+	// the writes of the other commands are applied even if a command fails like EXEC.
+	if _, ok := err.(*ScriptCommandError); err != nil && !ok {
+		status.TriggerAfterRollback(ctx)
+		return err
+	}
+	for _, onExec := range current.onExec {
+		onExec(results)
+	}
+	status.TriggerAfterCommit(ctx)
+	if err != nil {
+		return err
+	}
+	// the error matched with the no rollback rule is returned after the script.
+	return fnErr
+}
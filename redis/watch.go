@@ -0,0 +1,41 @@
+package gotx
+
+import (
+	"errors"
+
+	"github.com/knocknote/gotx"
+)
+
+// ErrNotWatching is returned by Watch outside the transaction begun with OptionWatch.
+var ErrNotWatching = errors.New("redis: the transaction is not begun with OptionWatch")
+
+// ErrWatchKeysRequired is returned when the transaction with WATCH begins on the cluster without the keys.
+// The node of the watching connection is determined by the keys of OptionWatch, so the keys can not be only watched dynamically.
+var ErrWatchKeysRequired = errors.New("redis: OptionWatch requires the keys on the cluster client")
+
+// Watch begins the transaction with WATCH. The transaction is retried if the watched keys are modified before EXEC.
+type Watch []string
+
+func (o Watch) Apply(c *gotx.Config) {
+	current := currentVendorOption(c)
+	current.watch = true
+	current.watchKeys = append(current.watchKeys, o...)
+}
+
+// OptionWatch watches the keys. The keys can be also watched dynamically by DefaultClientProvider.Watch in the transaction.
+func OptionWatch(keys ...string) Watch {
+	return keys
+}
+
+// WatchRetry is the max attempts of the transaction with WATCH including the first attempt. default is 3.
+type WatchRetry int
+
+func (o WatchRetry) Apply(c *gotx.Config) {
+	current := currentVendorOption(c)
+	current.watch = true
+	current.watchAttempts = int(o)
+}
+
+func OptionWatchRetry(maxAttempts int) WatchRetry {
+	return WatchRetry(maxAttempts)
+}
@@ -0,0 +1,202 @@
+package gotx
+
+import (
+	"context"
+	"sync"
+)
+
+// MigratingShardRouter routes the key by both the old and the new slot map during the online resharding.
+// The writes go to both shards and the reads go to the new shard with the fallback to the old shard until Switch is called.
+type MigratingShardRouter struct {
+	mu  sync.RWMutex
+	old *SlotMapRouter
+	new *SlotMapRouter
+	// the ranges of the slots moved by the new slot map in the order of the slot.
+	migrating []migratingRange
+	switched  bool
+}
+
+type migratingRange struct {
+	SlotRange
+	from int
+	to   int
+}
+
+// NewMigratingShardRouter returns error if the slot maps are invalid or have the different slots.
+func NewMigratingShardRouter(old *SlotMap, new *SlotMap) (*MigratingShardRouter, error) {
+	if old.MaxSlot != new.MaxSlot || old.Hash != new.Hash {
+		return nil, &SlotMapError{Reason: "maxSlot and hash of the old and the new slot map must be the same"}
+	}
+	oldRouter, err := old.compile()
+	if err != nil {
+		return nil, err
+	}
+	newRouter, err := new.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &MigratingShardRouter{
+		old:       oldRouter,
+		new:       newRouter,
+		migrating: migratingRanges(oldRouter, newRouter),
+	}, nil
+}
+
+// migratingRanges compares the ranges of the compiled slot maps, both of them cover all the slots in the order.
+func migratingRanges(old *SlotMapRouter, new *SlotMapRouter) []migratingRange {
+	var ranges []migratingRange
+	var start uint32
+	for i, j := 0, 0; i < len(old.entries) && j < len(new.entries); {
+		from := old.entries[i]
+		to := new.entries[j]
+		end := from.End
+		if to.End < end {
+			end = to.End
+		}
+		if from.shard != to.shard {
+			last := len(ranges) - 1
+			if last >= 0 && ranges[last].End+1 == start && ranges[last].from == from.shard && ranges[last].to == to.shard {
+				ranges[last].End = end
+			} else {
+				ranges = append(ranges, migratingRange{SlotRange: SlotRange{Start: start, End: end}, from: from.shard, to: to.shard})
+			}
+		}
+		if from.End == end {
+			i++
+		}
+		if to.End == end {
+			j++
+		}
+		start = end + 1
+	}
+	return ranges
+}
+
+// Size returns the number of the shards used by the old or the new slot map.
+func (r *MigratingShardRouter) Size() int {
+	size := 0
+	for _, entries := range [][]slotEntry{r.old.entries, r.new.entries} {
+		for _, e := range entries {
+			if e.shard >= size {
+				size = e.shard + 1
+			}
+		}
+	}
+	return size
+}
+
+// ShardIndex returns the shard of the new slot map.
+func (r *MigratingShardRouter) ShardIndex(shardKey []byte) int {
+	return r.new.ShardIndex(shardKey)
+}
+
+// WriteShards returns the new shard and the old shard if the slot is migrating.
+// The new shard comes first so that it is committed first.
+func (r *MigratingShardRouter) WriteShards(shardKey []byte) []int {
+	return r.shards(r.new.slot(shardKey))
+}
+
+// ReadShards returns the shards in the order of the fallback.
+// It is the same as WriteShards because the new shard has all the writes since the migration began
+// and the old shard has the rest until the slot is copied.
+func (r *MigratingShardRouter) ReadShards(shardKey []byte) []int {
+	return r.WriteShards(shardKey)
+}
+
+func (r *MigratingShardRouter) shards(slot uint32) []int {
+	to := r.new.slotIndex(slot)
+	if r.IsSwitched() {
+		return []int{to}
+	}
+	if from := r.old.slotIndex(slot); from != to {
+		return []int{to, from}
+	}
+	return []int{to}
+}
+
+// Switch completes the migration. Only the new shard is used after that.
+func (r *MigratingShardRouter) Switch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.switched = true
+}
+
+func (r *MigratingShardRouter) IsSwitched() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.switched
+}
+
+// SlotMigration is the slot moved from the old shard to the new shard.
+type SlotMigration struct {
+	Slot uint32
+	From int
+	To   int
+}
+
+// Migrations returns all the slots moved by the new slot map.
+func (r *MigratingShardRouter) Migrations() []SlotMigration {
+	var migrations []SlotMigration
+	for _, m := range r.migrating {
+		for slot := m.Start; slot <= m.End; slot++ {
+			migrations = append(migrations, SlotMigration{Slot: slot, From: m.from, To: m.to})
+		}
+	}
+	return migrations
+}
+
+// Slot returns the slot of the key.
+func (r *MigratingShardRouter) Slot(shardKey []byte) uint32 {
+	return r.new.slot(shardKey)
+}
+
+// --------------------------------
+// Copier
+// --------------------------------
+
+// SlotCopyFunc copies the data of the slot from the old shard to the new shard.
+type SlotCopyFunc func(ctx context.Context, migration SlotMigration) error
+
+type MigrationProgress struct {
+	Total  int
+	Copied int
+	// the slot copied last
+	Current SlotMigration
+}
+
+type CopierConfig struct {
+	// OnProgress is called after each slot is copied.
+	OnProgress func(progress MigrationProgress)
+}
+
+// Copier copies the data slot by slot while the writes go to both shards.
+type Copier struct {
+	router     *MigratingShardRouter
+	copy       SlotCopyFunc
+	onProgress func(progress MigrationProgress)
+}
+
+func NewCopier(router *MigratingShardRouter, copy SlotCopyFunc, config CopierConfig) *Copier {
+	return &Copier{
+		router:     router,
+		copy:       copy,
+		onProgress: config.OnProgress,
+	}
+}
+
+// Run copies all the moved slots. It stops at the first error or when the context is done.
+func (c *Copier) Run(ctx context.Context) error {
+	migrations := c.router.Migrations()
+	for i, migration := range migrations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.copy(ctx, migration); err != nil {
+			return err
+		}
+		if c.onProgress != nil {
+			c.onProgress(MigrationProgress{Total: len(migrations), Copied: i + 1, Current: migration})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package gotx
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryClassifier reports whether the failed transaction can be retried.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+type RetryClassifierFunc func(err error) bool
+
+func (f RetryClassifierFunc) IsRetryable(err error) bool {
+	return f(err)
+}
+
+// NewCompositeRetryClassifier retries the transaction if any of the classifiers reports the error is retryable.
+func NewCompositeRetryClassifier(classifiers ...RetryClassifier) RetryClassifier {
+	return RetryClassifierFunc(func(err error) bool {
+		for _, classifier := range classifiers {
+			if classifier.IsRetryable(err) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt. default is 3.
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the first backoff. default is 10ms.
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper bound of the backoff. default is 1s.
+	MaxBackoff time.Duration
+	// Multiplier grows the upper bound of the backoff for each attempt. default is 2.
+	Multiplier float64
+	Classifier RetryClassifier
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 10 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// backoff returns the full jitter backoff of the attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	upper := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		upper *= p.Multiplier
+		if upper >= float64(p.MaxBackoff) {
+			upper = float64(p.MaxBackoff)
+			break
+		}
+	}
+	return time.Duration(rand.Int63n(int64(upper) + 1))
+}
+
+// RetryingTransactor retries the transaction failed with the retryable error.
+// The transaction is retried only when the call begins a new transaction, the joined transaction is never retried.
+// Required and Nested are not retried in the scope of any transaction, including the transaction of the other backend.
+type RetryingTransactor struct {
+	transactor Transactor
+	policy     RetryPolicy
+}
+
+func NewRetryingTransactor(transactor Transactor, policy RetryPolicy) *RetryingTransactor {
+	return &RetryingTransactor{
+		transactor: transactor,
+		policy:     policy.withDefaults(),
+	}
+}
+
+func (t *RetryingTransactor) Required(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	if t.hasTransaction(ctx) {
+		return t.transactor.Required(ctx, fn, options...)
+	}
+	return t.retry(ctx, Transactor.Required, fn, options...)
+}
+
+func (t *RetryingTransactor) RequiresNew(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.retry(ctx, Transactor.RequiresNew, fn, options...)
+}
+
+func (t *RetryingTransactor) Supports(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Supports(ctx, fn, options...)
+}
+
+func (t *RetryingTransactor) Mandatory(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Mandatory(ctx, fn, options...)
+}
+
+func (t *RetryingTransactor) Never(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Never(ctx, fn, options...)
+}
+
+func (t *RetryingTransactor) NotSupported(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.NotSupported(ctx, fn, options...)
+}
+
+func (t *RetryingTransactor) Nested(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	if t.hasTransaction(ctx) {
+		return t.transactor.Nested(ctx, fn, options...)
+	}
+	return t.retry(ctx, Transactor.Nested, fn, options...)
+}
+
+// hasTransaction reports whether the call joins the transaction of any backend.
+func (t *RetryingTransactor) hasTransaction(ctx context.Context) bool {
+	return CurrentStatus(ctx) != nil
+}
+
+func (t *RetryingTransactor) retry(ctx context.Context, p propagation, fn DoInTransaction, options ...Option) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = p(t.transactor, ctx, fn, options...)
+		if err == nil || attempt >= t.policy.MaxAttempts || t.policy.Classifier == nil || !t.policy.Classifier.IsRetryable(err) {
+			return err
+		}
+		backoff := t.policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
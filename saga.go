@@ -0,0 +1,162 @@
+package gotx
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Compensation undoes the committed work when the other transaction of the CompositeTransactor fails.
+type Compensation func(ctx context.Context) error
+
+// RegisterCompensation registers the compensation for the member of the CompositeTransactor.
+// The target is the name of the member or the backend of the transaction.
+// The compensations are invoked in reverse order if the transaction of the member is committed and the other transaction is rolled back.
+// It does nothing outside the CompositeTransactor because a single transaction never commits partially.
+func RegisterCompensation(ctx context.Context, target string, compensation Compensation) error {
+	status, ok := CurrentStatus(ctx).(*compositeStatus)
+	if !ok {
+		return nil
+	}
+	var found *compositeMember
+	for _, member := range status.members {
+		if member.status == nil || (member.name != target && member.status.Backend() != target) {
+			continue
+		}
+		if found != nil && found.status != member.status {
+			return fmt.Errorf("multiple transactions of %s found in the composite transaction", target)
+		}
+		found = member
+	}
+	if found == nil {
+		return fmt.Errorf("no transaction of %s found in the composite transaction", target)
+	}
+	found.addCompensation(compensation)
+	return nil
+}
+
+// CompensationError is the error returned from the compensation.
+type CompensationError struct {
+	// Member is the name of the member or the backend of the transaction.
+	Member string
+	Err    error
+}
+
+func (e *CompensationError) Error() string {
+	return fmt.Sprintf("compensation of %s failed: %v", e.Member, e.Err)
+}
+
+func (e *CompensationError) Unwrap() error {
+	return e.Err
+}
+
+// CompositeError is returned when the CompositeTransactor commits some transactions and rolls back the others.
+type CompositeError struct {
+	// Err is the error which rolled back the transactions.
+	Err error
+	// Committed and RolledBack are the names of the members or the backends of the transactions.
+	Committed          []string
+	RolledBack         []string
+	CompensationErrors []*CompensationError
+}
+
+func (e *CompositeError) Error() string {
+	message := fmt.Sprintf("composite transaction partially failed: committed=%v, rolled back=%v: %v", e.Committed, e.RolledBack, e.Err)
+	if len(e.CompensationErrors) > 0 {
+		errs := make([]string, len(e.CompensationErrors))
+		for i, compensationErr := range e.CompensationErrors {
+			errs[i] = compensationErr.Error()
+		}
+		message += ": " + strings.Join(errs, ", ")
+	}
+	return message
+}
+
+func (e *CompositeError) Unwrap() error {
+	return e.Err
+}
+
+// state of the transactor in a call of the CompositeTransactor.
+type compositeMember struct {
+	name          string
+	readOnly      bool
+	mu            sync.Mutex
+	status        TransactionStatus
+	completed     bool
+	committed     bool
+	compensations []Compensation
+}
+
+func (m *compositeMember) reset(status TransactionStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = status
+	m.completed = false
+	m.committed = false
+	m.compensations = nil
+	if status == nil || !status.IsNewTransaction() {
+		return
+	}
+	if registry, ok := status.(synchronizationRegistry); ok {
+		registry.RegisterSynchronization(SynchronizationFuncs{
+			OnAfterCompletion: func(_ context.Context, committed bool) {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				m.completed = true
+				m.committed = committed
+			},
+		})
+	}
+}
+
+func (m *compositeMember) label() string {
+	if m.name != "" {
+		return m.name
+	}
+	return m.status.Backend()
+}
+
+func (m *compositeMember) addCompensation(compensation Compensation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compensations = append(m.compensations, compensation)
+}
+
+// compensate invokes the compensations of the committed transactions if the other transaction is rolled back.
+func compensate(ctx context.Context, members []*compositeMember, err error) error {
+	var committed, rolledBack []*compositeMember
+	for _, member := range members {
+		if !member.completed || member.readOnly {
+			continue
+		}
+		if member.committed {
+			committed = append(committed, member)
+		} else {
+			rolledBack = append(rolledBack, member)
+		}
+	}
+	if len(committed) == 0 || len(rolledBack) == 0 {
+		return err
+	}
+	compositeErr := &CompositeError{Err: err}
+	for _, member := range rolledBack {
+		compositeErr.RolledBack = append(compositeErr.RolledBack, member.label())
+	}
+	for _, member := range committed {
+		compositeErr.Committed = append(compositeErr.Committed, member.label())
+	}
+	// the last committed transaction is compensated first.
+	for i := len(committed) - 1; i >= 0; i-- {
+		member := committed[i]
+		for j := len(member.compensations) - 1; j >= 0; j-- {
+			if compensationErr := member.compensations[j](ctx); compensationErr != nil {
+				compositeErr.CompensationErrors = append(compositeErr.CompensationErrors, &CompensationError{
+					Member: member.label(),
+					Err:    compensationErr,
+				})
+			}
+		}
+	}
+	return compositeErr
+}
@@ -0,0 +1,111 @@
+package gotx
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShardError is the error of the shard in the fan-out query.
+type ShardError struct {
+	Shard int
+	Err   error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %d: %v", e.Shard, e.Err)
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// ScatterGatherError aggregates the errors of all the failed shards.
+type ScatterGatherError struct {
+	Errors []*ShardError
+}
+
+func (e *ScatterGatherError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d shards failed: %s", len(e.Errors), strings.Join(messages, ", "))
+}
+
+// Unwrap returns the error of the first failed shard.
+func (e *ScatterGatherError) Unwrap() error {
+	return e.Errors[0]
+}
+
+type ScatterGatherConfig struct {
+	// the number of the shards queried at the same time. default is all the shards.
+	Concurrency int
+	// Less sorts the merged results if it is set. Otherwise the results are ordered by the shard.
+	Less func(a, b interface{}) bool
+	// run the function in the read-only transaction of each shard if the backend supports it.
+	ReadOnly bool
+}
+
+// ForEachShard calls fn for each shard in order. It stops at the first error.
+func ForEachShard(ctx context.Context, size int, fn func(ctx context.Context, shard int) error) error {
+	for shard := 0; shard < size; shard++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(ctx, shard); err != nil {
+			return &ShardError{Shard: shard, Err: err}
+		}
+	}
+	return nil
+}
+
+// ScatterGather calls fn for each shard in parallel and merges the results.
+// The results of the succeeded shards are returned with the ScatterGatherError if some shards failed.
+func ScatterGather(ctx context.Context, size int, fn func(ctx context.Context, shard int) ([]interface{}, error), config ScatterGatherConfig) ([]interface{}, error) {
+	concurrency := config.Concurrency
+	if concurrency <= 0 || concurrency > size {
+		concurrency = size
+	}
+	results := make([][]interface{}, size)
+	errs := make([]error, size)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for shard := 0; shard < size; shard++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(shard int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if err := ctx.Err(); err != nil {
+				errs[shard] = err
+				return
+			}
+			results[shard], errs[shard] = fn(ctx, shard)
+		}(shard)
+	}
+	wg.Wait()
+
+	var merged []interface{}
+	var shardErrors []*ShardError
+	for shard := 0; shard < size; shard++ {
+		if errs[shard] != nil {
+			shardErrors = append(shardErrors, &ShardError{Shard: shard, Err: errs[shard]})
+			continue
+		}
+		merged = append(merged, results[shard]...)
+	}
+	if config.Less != nil {
+		sort.SliceStable(merged, func(i, j int) bool {
+			return config.Less(merged[i], merged[j])
+		})
+	}
+	if len(shardErrors) > 0 {
+		return merged, &ScatterGatherError{Errors: shardErrors}
+	}
+	return merged, nil
+}
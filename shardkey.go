@@ -0,0 +1,110 @@
+package gotx
+
+import "context"
+
+type shardKeyContextKey struct{}
+
+// ShardKeyNotFoundError is returned when no shard key is set in the context.
+type ShardKeyNotFoundError struct{}
+
+func (e *ShardKeyNotFoundError) Error() string {
+	return "shard key is not set in the context"
+}
+
+// WithShardKey sets the shard key read by StrictShardKeyProvider.
+func WithShardKey(ctx context.Context, shardKey string) context.Context {
+	return context.WithValue(ctx, shardKeyContextKey{}, shardKey)
+}
+
+// ShardKeyFromContext returns the shard key set by WithShardKey.
+func ShardKeyFromContext(ctx context.Context) (string, error) {
+	shardKey, ok := ctx.Value(shardKeyContextKey{}).(string)
+	if !ok {
+		return "", &ShardKeyNotFoundError{}
+	}
+	return shardKey, nil
+}
+
+// ShardKeyResolver returns the shard key or the error if the key can not be determined.
+type ShardKeyResolver func(ctx context.Context) (string, error)
+
+type shardKeyErrorKey struct{}
+
+// ShardKeyProviderOf adapts the resolver to the shard key provider of the rdbms and redis packages.
+// The error of the resolver is returned by ResolveShardKey, which is used by all the providers and transactors of them.
+// The provider returns the empty key if it is called without ResolveShardKey.
+func ShardKeyProviderOf(resolver ShardKeyResolver) func(ctx context.Context) string {
+	return func(ctx context.Context) string {
+		shardKey, err := resolver(ctx)
+		if err != nil {
+			if sink, ok := ctx.Value(shardKeyErrorKey{}).(*error); ok {
+				*sink = err
+			}
+			return ""
+		}
+		return shardKey
+	}
+}
+
+// StrictShardKeyProvider is the shard key provider of the rdbms and redis packages which reads the key set by WithShardKey.
+// ResolveShardKey returns ShardKeyNotFoundError instead of hashing the empty key if no key is set.
+var StrictShardKeyProvider = ShardKeyProviderOf(ShardKeyFromContext)
+
+// ResolveShardKey returns the error of the provider adapted by ShardKeyProviderOf.
+func ResolveShardKey(ctx context.Context, provider func(ctx context.Context) string) (string, error) {
+	var err error
+	shardKey := provider(context.WithValue(ctx, shardKeyErrorKey{}, &err))
+	if err != nil {
+		return "", err
+	}
+	return shardKey, nil
+}
+
+// ShardKeyTransactor makes the shard explicit at the call site.
+type ShardKeyTransactor struct {
+	transactor Transactor
+}
+
+func NewShardKeyTransactor(transactor Transactor) *ShardKeyTransactor {
+	return &ShardKeyTransactor{
+		transactor: transactor,
+	}
+}
+
+// RequiredFor runs fn in the transaction of the shard determined by the shard key.
+func (t *ShardKeyTransactor) RequiredFor(ctx context.Context, shardKey string, fn DoInTransaction, options ...Option) error {
+	return t.Required(WithShardKey(ctx, shardKey), fn, options...)
+}
+
+// RequiresNewFor runs fn in the new transaction of the shard determined by the shard key.
+func (t *ShardKeyTransactor) RequiresNewFor(ctx context.Context, shardKey string, fn DoInTransaction, options ...Option) error {
+	return t.RequiresNew(WithShardKey(ctx, shardKey), fn, options...)
+}
+
+func (t *ShardKeyTransactor) Required(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Required(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) RequiresNew(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.RequiresNew(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) Supports(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Supports(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) Mandatory(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Mandatory(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) Never(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Never(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) NotSupported(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.NotSupported(ctx, fn, options...)
+}
+
+func (t *ShardKeyTransactor) Nested(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.transactor.Nested(ctx, fn, options...)
+}
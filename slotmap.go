@@ -0,0 +1,228 @@
+package gotx
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SlotHashCRC32 = "crc32"
+	// crc16 with the {hashtag} same as the Redis Cluster
+	SlotHashCRC16 = "crc16"
+)
+
+// SlotRange is the slots from Start to End inclusive.
+type SlotRange struct {
+	Start uint32 `json:"start" yaml:"start"`
+	End   uint32 `json:"end" yaml:"end"`
+}
+
+type SlotShard struct {
+	// index of the connections
+	Shard int `json:"shard" yaml:"shard"`
+	// the slots are assigned in proportion to the weight if no ranges are listed in the slot map. default is 1.
+	Weight int         `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Ranges []SlotRange `json:"ranges,omitempty" yaml:"ranges,omitempty"`
+}
+
+// SlotMap lists the slot ranges of each shard.
+type SlotMap struct {
+	MaxSlot uint32 `json:"maxSlot" yaml:"maxSlot"`
+	// crc32 or crc16. default is crc32.
+	Hash   string      `json:"hash,omitempty" yaml:"hash,omitempty"`
+	Shards []SlotShard `json:"shards" yaml:"shards"`
+}
+
+// SlotMapError is returned when the slot map is invalid.
+type SlotMapError struct {
+	Reason string
+}
+
+func (e *SlotMapError) Error() string {
+	return fmt.Sprintf("invalid slot map: %s", e.Reason)
+}
+
+// NewWeightedSlotMap assigns the contiguous slots in proportion to the weight of each shard.
+func NewWeightedSlotMap(maxSlot uint32, weights ...int) *SlotMap {
+	m := &SlotMap{MaxSlot: maxSlot}
+	for i, weight := range weights {
+		m.Shards = append(m.Shards, SlotShard{Shard: i, Weight: weight})
+	}
+	return m
+}
+
+// LoadSlotMap loads the slot map from the yaml file if the extension is .yaml or .yml, otherwise from the json file.
+func LoadSlotMap(path string) (*SlotMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return ParseSlotMapYAML(data)
+	default:
+		return ParseSlotMapJSON(data)
+	}
+}
+
+func ParseSlotMapJSON(data []byte) (*SlotMap, error) {
+	m := &SlotMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, m.Validate()
+}
+
+func ParseSlotMapYAML(data []byte) (*SlotMap, error) {
+	m := &SlotMap{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, m.Validate()
+}
+
+// Validate checks that the slot ranges cover all the slots without gaps and overlaps.
+func (m *SlotMap) Validate() error {
+	_, err := m.compile()
+	return err
+}
+
+// Size returns the number of the shards.
+func (m *SlotMap) Size() int {
+	return len(m.Shards)
+}
+
+// Router returns the ShardRouter of the validated slot map.
+func (m *SlotMap) Router() (ShardRouter, error) {
+	return m.compile()
+}
+
+type slotEntry struct {
+	SlotRange
+	shard int
+}
+
+func (m *SlotMap) compile() (*SlotMapRouter, error) {
+	if m.MaxSlot == 0 {
+		return nil, &SlotMapError{Reason: "maxSlot is required"}
+	}
+	var slot func([]byte) uint32
+	switch m.Hash {
+	case "", SlotHashCRC32:
+		slot = func(key []byte) uint32 {
+			return crc32.ChecksumIEEE(key) % m.MaxSlot
+		}
+	case SlotHashCRC16:
+		slot = func(key []byte) uint32 {
+			return uint32(crc16(hashTag(key))) % m.MaxSlot
+		}
+	default:
+		return nil, &SlotMapError{Reason: fmt.Sprintf("unknown hash %s", m.Hash)}
+	}
+	if len(m.Shards) == 0 {
+		return nil, &SlotMapError{Reason: "no shards"}
+	}
+	seen := make([]bool, len(m.Shards))
+	listed := 0
+	for _, shard := range m.Shards {
+		if shard.Shard < 0 || shard.Shard >= len(m.Shards) || seen[shard.Shard] {
+			return nil, &SlotMapError{Reason: fmt.Sprintf("shard %d is duplicated or out of range", shard.Shard)}
+		}
+		if shard.Weight < 0 {
+			return nil, &SlotMapError{Reason: fmt.Sprintf("weight of shard %d must be positive", shard.Shard)}
+		}
+		seen[shard.Shard] = true
+		if len(shard.Ranges) > 0 {
+			listed++
+		}
+	}
+	var entries []slotEntry
+	switch listed {
+	case 0:
+		entries = m.weightedEntries()
+	case len(m.Shards):
+		for _, shard := range m.Shards {
+			for _, r := range shard.Ranges {
+				entries = append(entries, slotEntry{SlotRange: r, shard: shard.Shard})
+			}
+		}
+	default:
+		return nil, &SlotMapError{Reason: "ranges must be listed for all the shards or none of them"}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Start < entries[j].Start
+	})
+	var next uint32
+	for _, e := range entries {
+		if e.Start > e.End || e.End >= m.MaxSlot {
+			return nil, &SlotMapError{Reason: fmt.Sprintf("range %d-%d of shard %d is out of range", e.Start, e.End, e.shard)}
+		}
+		if e.Start < next {
+			return nil, &SlotMapError{Reason: fmt.Sprintf("range %d-%d of shard %d overlaps", e.Start, e.End, e.shard)}
+		}
+		if e.Start > next {
+			return nil, &SlotMapError{Reason: fmt.Sprintf("slots %d-%d are not assigned", next, e.Start-1)}
+		}
+		next = e.End + 1
+	}
+	if next != m.MaxSlot {
+		return nil, &SlotMapError{Reason: fmt.Sprintf("slots %d-%d are not assigned", next, m.MaxSlot-1)}
+	}
+	return &SlotMapRouter{entries: entries, slot: slot}, nil
+}
+
+func (m *SlotMap) weightedEntries() []slotEntry {
+	total := 0
+	for _, shard := range m.Shards {
+		total += weight(shard)
+	}
+	var entries []slotEntry
+	var start uint32
+	sum := 0
+	for i, shard := range m.Shards {
+		sum += weight(shard)
+		bound := uint32(uint64(m.MaxSlot) * uint64(sum) / uint64(total))
+		if i == len(m.Shards)-1 {
+			bound = m.MaxSlot
+		}
+		// the shard with too small weight may have no slots
+		if bound > start {
+			entries = append(entries, slotEntry{SlotRange: SlotRange{Start: start, End: bound - 1}, shard: shard.Shard})
+			start = bound
+		}
+	}
+	return entries
+}
+
+func weight(shard SlotShard) int {
+	if shard.Weight == 0 {
+		return 1
+	}
+	return shard.Weight
+}
+
+// SlotMapRouter routes the key by the slot map.
+type SlotMapRouter struct {
+	entries []slotEntry
+	slot    func([]byte) uint32
+}
+
+func (r *SlotMapRouter) ShardIndex(shardKey []byte) int {
+	return r.slotIndex(r.slot(shardKey))
+}
+
+func (r *SlotMapRouter) slotIndex(slot uint32) int {
+	i := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].End >= slot
+	})
+	if i == len(r.entries) {
+		return -1
+	}
+	return r.entries[i].shard
+}
@@ -0,0 +1,16 @@
+package gotx
+
+import (
+	"github.com/knocknote/gotx"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// NewRetryClassifier retries the transaction aborted by spanner.
+// The spanner client retries the aborted transaction by itself, this is for the error returned after its retries.
+func NewRetryClassifier() gotx.RetryClassifier {
+	return gotx.RetryClassifierFunc(func(err error) bool {
+		return spanner.ErrCode(err) == codes.Aborted
+	})
+}
@@ -134,11 +134,11 @@ func NewDefaultClientProviderWithFactory(client *spanner.Client, factory ClientF
 }
 
 func (p *DefaultClientProvider) CurrentClient(ctx context.Context) Client {
-	transaction := ctx.Value(currentTransactionKey)
-	if transaction == nil {
+	current := ctx.Value(currentTransactionKey)
+	if current == nil {
 		return p.singleClient
 	}
-	return transaction.(Client)
+	return current.(*transaction).Client
 }
 
 type ClientFactory interface {
@@ -166,6 +166,12 @@ func OptionTransactionOptions(options spanner.TransactionOptions) TransactionOpt
 	return TransactionOptions(options)
 }
 
+// transaction stored in the context.
+type transaction struct {
+	Client
+	status *gotx.DefaultTransactionStatus
+}
+
 type Transactor struct {
 	spannerClient *spanner.Client
 	clientFactory ClientFactory
@@ -196,12 +202,52 @@ func NewTransactorWithConfig(spannerClient *spanner.Client, config TransactorCon
 }
 
 func (t *Transactor) Required(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
-	if ctx.Value(currentTransactionKey) != nil {
+	current := ctx.Value(currentTransactionKey)
+	if current == nil {
+		return t.RequiresNew(ctx, fn, options...)
+	}
+	return fn(gotx.WithStatus(ctx, current.(*transaction).status.Join()))
+}
+
+func (t *Transactor) Supports(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current := ctx.Value(currentTransactionKey)
+	if current == nil {
 		return fn(ctx)
 	}
+	return fn(gotx.WithStatus(ctx, current.(*transaction).status.Join()))
+}
+
+func (t *Transactor) Mandatory(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	current := ctx.Value(currentTransactionKey)
+	if current == nil {
+		return gotx.NewMandatoryError()
+	}
+	return fn(gotx.WithStatus(ctx, current.(*transaction).status.Join()))
+}
+
+func (t *Transactor) Never(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	if t.hasTransaction(ctx) {
+		return gotx.NewNeverError()
+	}
+	return fn(ctx)
+}
+
+func (t *Transactor) NotSupported(ctx context.Context, fn gotx.DoInTransaction, _ ...gotx.Option) error {
+	// the client provider returns the single use client if the transaction is nil.
+	return fn(gotx.WithStatus(context.WithValue(ctx, currentTransactionKey, nil), nil))
+}
+
+func (t *Transactor) Nested(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
+	if t.hasTransaction(ctx) {
+		return &gotx.NestedTransactionNotSupportedError{Backend: "spanner"}
+	}
 	return t.RequiresNew(ctx, fn, options...)
 }
 
+func (t *Transactor) hasTransaction(ctx context.Context) bool {
+	return ctx.Value(currentTransactionKey) != nil
+}
+
 var rollbackOnly = errors.New("rollback only transaction")
 
 func (t *Transactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, options ...gotx.Option) error {
@@ -212,30 +258,67 @@ func (t *Transactor) RequiresNew(ctx context.Context, fn gotx.DoInTransaction, o
 		opt.Apply(&config)
 	}
 
+	// the vendor option may be given for the other data source in the composite transactor.
+	transactionOptions, _ := config.VendorOption.(spanner.TransactionOptions)
+
 	if config.ReadOnly {
 		txn := t.spannerClient.ReadOnlyTransaction()
 		defer txn.Close()
-		executor := t.clientFactory.NewClient(t.spannerClient, nil, txn)
-		return fn(context.WithValue(ctx, currentTransactionKey, executor))
+		status := gotx.NewTransactionStatus("spanner", true, config)
+		current := &transaction{Client: t.clientFactory.NewClient(t.spannerClient, nil, txn), status: status}
+		txCtx := gotx.WithStatus(context.WithValue(ctx, currentTransactionKey, current), status)
+		err := fn(txCtx)
+		// read only transaction has nothing to commit, so the successful completion is treated as commit.
+		if !config.ShouldRollback(err) && !status.IsRollbackOnly() {
+			syncErr := status.TriggerBeforeCommit(txCtx)
+			if syncErr == nil {
+				status.TriggerAfterCommit(ctx)
+				return err
+			}
+			err = syncErr
+		}
+		status.TriggerAfterRollback(ctx)
+		return err
 	}
+	var fnErr error
+	var status *gotx.DefaultTransactionStatus
+	defer func() {
+		if p := recover(); p != nil {
+			if status != nil {
+				status.TriggerAfterRollback(ctx)
+			}
+			panic(p)
+		}
+	}()
 	commitResponse, err := t.spannerClient.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		executor := t.clientFactory.NewClient(t.spannerClient, txn, nil)
-		err := fn(context.WithValue(ctx, currentTransactionKey, executor))
-		if err != nil {
-			return err
+		// the status is created for each attempt because the aborted transaction is retried.
+		status = gotx.NewTransactionStatus("spanner", true, config)
+		current := &transaction{Client: t.clientFactory.NewClient(t.spannerClient, txn, nil), status: status}
+		txCtx := gotx.WithStatus(context.WithValue(ctx, currentTransactionKey, current), status)
+		fnErr = fn(txCtx)
+		if config.ShouldRollback(fnErr) {
+			return fnErr
 		}
-		if config.RollbackOnly {
+		if status.IsRollbackOnly() {
 			return rollbackOnly
 		}
-		return nil
-	}, config.VendorOption.(spanner.TransactionOptions))
-	// rollback only transaction
-	if err != nil && errors.Is(err, rollbackOnly) {
-		return nil
+		return status.TriggerBeforeCommit(txCtx)
+	}, transactionOptions)
+	if err != nil {
+		if status != nil {
+			status.TriggerAfterRollback(ctx)
+		}
+		// rollback only transaction
+		if errors.Is(err, rollbackOnly) {
+			return fnErr
+		}
+		return err
 	}
 	// commit hook
-	if err == nil && t.onCommit != nil {
+	if t.onCommit != nil {
 		t.onCommit(&commitResponse)
 	}
-	return err
+	status.TriggerAfterCommit(ctx)
+	// the error matched with the no rollback rule is returned after commit.
+	return fnErr
 }
@@ -0,0 +1,275 @@
+package gotx
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type TransactionStatus interface {
+	// IsNewTransaction returns false if the scope joined the existing transaction.
+	IsNewTransaction() bool
+	IsReadOnly() bool
+	// SetRollbackOnly makes the transaction roll back instead of commit.
+	SetRollbackOnly()
+	IsRollbackOnly() bool
+	Name() string
+	Backend() string
+}
+
+type contextStatusKey string
+
+const currentStatusKey contextStatusKey = "current_transaction_status"
+
+// CurrentStatus returns the status of the innermost transaction scope, nil if no transaction exists.
+func CurrentStatus(ctx context.Context) TransactionStatus {
+	status := ctx.Value(currentStatusKey)
+	if status == nil {
+		return nil
+	}
+	return status.(TransactionStatus)
+}
+
+// HasTransactionOf reports whether the current transaction includes the transaction of the backend.
+// The transaction of the CompositeTransactor includes the transactions of its members.
+func HasTransactionOf(ctx context.Context, backend string) bool {
+	return includesBackend(CurrentStatus(ctx), backend)
+}
+
+func includesBackend(status TransactionStatus, backend string) bool {
+	if status == nil {
+		return false
+	}
+	if composite, ok := status.(*compositeStatus); ok {
+		for _, member := range composite.statuses {
+			if includesBackend(member, backend) {
+				return true
+			}
+		}
+		return false
+	}
+	return status.Backend() == backend
+}
+
+// WithStatus is used by Transactor to populate the status. nil removes the current status.
+func WithStatus(ctx context.Context, status TransactionStatus) context.Context {
+	return context.WithValue(ctx, currentStatusKey, status)
+}
+
+type DefaultTransactionStatus struct {
+	name           string
+	backend        string
+	readOnly       bool
+	newTransaction bool
+	rollbackOnly   int32
+	// the status of the transaction which this scope joined.
+	root *DefaultTransactionStatus
+	// the status of the transaction which this nested scope belongs to.
+	outer            *DefaultTransactionStatus
+	mu               sync.Mutex
+	synchronizations []Synchronization
+}
+
+func NewTransactionStatus(backend string, newTransaction bool, config Config) *DefaultTransactionStatus {
+	status := &DefaultTransactionStatus{
+		name:           config.Name,
+		backend:        backend,
+		readOnly:       config.ReadOnly,
+		newTransaction: newTransaction,
+	}
+	if config.RollbackOnly {
+		status.SetRollbackOnly()
+	}
+	return status
+}
+
+// Join returns the status of the scope joining this transaction.
+func (s *DefaultTransactionStatus) Join() *DefaultTransactionStatus {
+	return &DefaultTransactionStatus{
+		name:           s.name,
+		backend:        s.backend,
+		readOnly:       s.readOnly,
+		newTransaction: false,
+		root:           s.Root(),
+	}
+}
+
+// Nest returns the status of the nested scope, which can roll back independently of this transaction.
+func (s *DefaultTransactionStatus) Nest(config Config) *DefaultTransactionStatus {
+	status := NewTransactionStatus(s.backend, false, config)
+	status.outer = s
+	return status
+}
+
+// Root returns the status of the scope which began the transaction.
+func (s *DefaultTransactionStatus) Root() *DefaultTransactionStatus {
+	if s.root == nil {
+		return s
+	}
+	return s.root
+}
+
+func (s *DefaultTransactionStatus) IsNewTransaction() bool {
+	return s.newTransaction
+}
+
+func (s *DefaultTransactionStatus) IsReadOnly() bool {
+	return s.readOnly
+}
+
+func (s *DefaultTransactionStatus) SetRollbackOnly() {
+	atomic.StoreInt32(&s.Root().rollbackOnly, 1)
+}
+
+func (s *DefaultTransactionStatus) IsRollbackOnly() bool {
+	return atomic.LoadInt32(&s.Root().rollbackOnly) == 1
+}
+
+func (s *DefaultTransactionStatus) Name() string {
+	return s.name
+}
+
+func (s *DefaultTransactionStatus) Backend() string {
+	return s.backend
+}
+
+// status of the CompositeTransactor. It consists of the statuses of the transactors.
+type compositeStatus struct {
+	statuses []TransactionStatus
+	members  []*compositeMember
+}
+
+func newCompositeStatus(members []*compositeMember) *compositeStatus {
+	var statuses []TransactionStatus
+	for _, member := range members {
+		if member.status != nil && !containsStatus(statuses, member.status) {
+			statuses = append(statuses, member.status)
+		}
+	}
+	if len(statuses) == 0 {
+		return nil
+	}
+	return &compositeStatus{
+		statuses: statuses,
+		members:  members,
+	}
+}
+
+func containsStatus(statuses []TransactionStatus, target TransactionStatus) bool {
+	for _, status := range statuses {
+		if status == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DefaultTransactionStatus) RegisterSynchronization(sync Synchronization) {
+	owner := s.synchronizationOwner()
+	owner.mu.Lock()
+	defer owner.mu.Unlock()
+	owner.synchronizations = append(owner.synchronizations, sync)
+}
+
+func (s *DefaultTransactionStatus) synchronizationOwner() *DefaultTransactionStatus {
+	if s.root != nil {
+		return s.root.synchronizationOwner()
+	}
+	if s.outer != nil {
+		return s.outer.synchronizationOwner()
+	}
+	return s
+}
+
+func (s *DefaultTransactionStatus) registeredSynchronizations() []Synchronization {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Synchronization(nil), s.synchronizations...)
+}
+
+// TriggerBeforeCommit is used by Transactor to invoke BeforeCommit in registration order.
+func (s *DefaultTransactionStatus) TriggerBeforeCommit(ctx context.Context) error {
+	for _, sync := range s.registeredSynchronizations() {
+		if err := sync.BeforeCommit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TriggerAfterCommit is used by Transactor to invoke AfterCommit and AfterCompletion in registration order.
+func (s *DefaultTransactionStatus) TriggerAfterCommit(ctx context.Context) {
+	synchronizations := s.registeredSynchronizations()
+	for _, sync := range synchronizations {
+		sync.AfterCommit(ctx)
+	}
+	for _, sync := range synchronizations {
+		sync.AfterCompletion(ctx, true)
+	}
+}
+
+// TriggerAfterCompletion is used by Transactor to invoke only AfterCompletion when the commit is decided but its outcome is unknown.
+func (s *DefaultTransactionStatus) TriggerAfterCompletion(ctx context.Context, committed bool) {
+	for _, sync := range s.registeredSynchronizations() {
+		sync.AfterCompletion(ctx, committed)
+	}
+}
+
+// TriggerAfterRollback is used by Transactor to invoke AfterRollback and AfterCompletion in registration order.
+func (s *DefaultTransactionStatus) TriggerAfterRollback(ctx context.Context) {
+	synchronizations := s.registeredSynchronizations()
+	for _, sync := range synchronizations {
+		sync.AfterRollback(ctx)
+	}
+	for _, sync := range synchronizations {
+		sync.AfterCompletion(ctx, false)
+	}
+}
+
+func (s *compositeStatus) IsNewTransaction() bool {
+	for _, status := range s.statuses {
+		if status.IsNewTransaction() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compositeStatus) IsReadOnly() bool {
+	for _, status := range s.statuses {
+		if !status.IsReadOnly() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *compositeStatus) SetRollbackOnly() {
+	for _, status := range s.statuses {
+		status.SetRollbackOnly()
+	}
+}
+
+func (s *compositeStatus) IsRollbackOnly() bool {
+	for _, status := range s.statuses {
+		if status.IsRollbackOnly() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compositeStatus) Name() string {
+	return s.statuses[0].Name()
+}
+
+func (s *compositeStatus) Backend() string {
+	return "composite"
+}
+
+// RegisterSynchronization registers the synchronization to the outermost transaction, which is committed last.
+func (s *compositeStatus) RegisterSynchronization(sync Synchronization) {
+	if registry, ok := s.statuses[len(s.statuses)-1].(synchronizationRegistry); ok {
+		registry.RegisterSynchronization(sync)
+	}
+}
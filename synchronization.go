@@ -0,0 +1,69 @@
+package gotx
+
+import (
+	"context"
+	"errors"
+)
+
+// Synchronization is the callback for the transaction completion.
+type Synchronization interface {
+	// BeforeCommit is invoked in the transaction before commit. The transaction rolls back if it returns error.
+	BeforeCommit(ctx context.Context) error
+	// AfterCommit is invoked after the transaction is committed.
+	AfterCommit(ctx context.Context)
+	// AfterRollback is invoked after the transaction is rolled back.
+	AfterRollback(ctx context.Context)
+	// AfterCompletion is invoked after AfterCommit or AfterRollback.
+	// It is invoked alone with committed=true when the commit is decided but not finished, such as the in-doubt xa transaction.
+	AfterCompletion(ctx context.Context, committed bool)
+}
+
+// SynchronizationFuncs implements Synchronization with the optional functions.
+type SynchronizationFuncs struct {
+	OnBeforeCommit    func(ctx context.Context) error
+	OnAfterCommit     func(ctx context.Context)
+	OnAfterRollback   func(ctx context.Context)
+	OnAfterCompletion func(ctx context.Context, committed bool)
+}
+
+func (s SynchronizationFuncs) BeforeCommit(ctx context.Context) error {
+	if s.OnBeforeCommit == nil {
+		return nil
+	}
+	return s.OnBeforeCommit(ctx)
+}
+
+func (s SynchronizationFuncs) AfterCommit(ctx context.Context) {
+	if s.OnAfterCommit != nil {
+		s.OnAfterCommit(ctx)
+	}
+}
+
+func (s SynchronizationFuncs) AfterRollback(ctx context.Context) {
+	if s.OnAfterRollback != nil {
+		s.OnAfterRollback(ctx)
+	}
+}
+
+func (s SynchronizationFuncs) AfterCompletion(ctx context.Context, committed bool) {
+	if s.OnAfterCompletion != nil {
+		s.OnAfterCompletion(ctx, committed)
+	}
+}
+
+var ErrSynchronizationNotActive = errors.New("transaction synchronization is not active")
+
+type synchronizationRegistry interface {
+	RegisterSynchronization(sync Synchronization)
+}
+
+// RegisterSynchronization registers the synchronization to the current transaction.
+// The synchronization registered in the joined scope is invoked at the completion of the outermost transaction.
+func RegisterSynchronization(ctx context.Context, sync Synchronization) error {
+	registry, ok := CurrentStatus(ctx).(synchronizationRegistry)
+	if !ok {
+		return ErrSynchronizationNotActive
+	}
+	registry.RegisterSynchronization(sync)
+	return nil
+}
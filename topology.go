@@ -0,0 +1,16 @@
+package gotx
+
+import "time"
+
+// ReloadEvent is emitted when the reload of the shard topology completes.
+type ReloadEvent struct {
+	// the number of the connections added and removed by the reload
+	Added   int
+	Removed int
+	// time to drain and close the removed connections
+	Elapsed time.Duration
+	// the first error to drain or close the removed connections
+	Err error
+}
+
+type ReloadHook func(event ReloadEvent)
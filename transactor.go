@@ -2,6 +2,8 @@ package gotx
 
 import (
 	"context"
+	"fmt"
+	"sort"
 )
 
 type DoInTransaction func(ctx context.Context) error
@@ -11,45 +13,190 @@ type Transactor interface {
 	Required(ctx context.Context, fn DoInTransaction, options ...Option) error
 	// Create a new transaction, and suspend the current transaction if one exists.
 	RequiresNew(ctx context.Context, fn DoInTransaction, options ...Option) (err error)
+	// Support a current transaction, execute non-transactionally if none exists.
+	Supports(ctx context.Context, fn DoInTransaction, options ...Option) error
+	// Support a current transaction, return an error if none exists.
+	Mandatory(ctx context.Context, fn DoInTransaction, options ...Option) error
+	// Execute non-transactionally, return an error if a transaction exists.
+	Never(ctx context.Context, fn DoInTransaction, options ...Option) error
+	// Execute non-transactionally, suspend the current transaction if one exists.
+	NotSupported(ctx context.Context, fn DoInTransaction, options ...Option) error
+	// Execute within a nested transaction if a current transaction exists, behave like Required otherwise.
+	Nested(ctx context.Context, fn DoInTransaction, options ...Option) error
+}
+
+// IllegalTransactionStateError is returned when the transaction state in the context doesn't match the propagation.
+type IllegalTransactionStateError struct {
+	Propagation string
+	Existing    bool
+}
+
+func (e *IllegalTransactionStateError) Error() string {
+	if e.Existing {
+		return fmt.Sprintf("existing transaction found for transaction marked with propagation '%s'", e.Propagation)
+	}
+	return fmt.Sprintf("no existing transaction found for transaction marked with propagation '%s'", e.Propagation)
+}
+
+func NewMandatoryError() error {
+	return &IllegalTransactionStateError{Propagation: "mandatory", Existing: false}
+}
+
+func NewNeverError() error {
+	return &IllegalTransactionStateError{Propagation: "never", Existing: true}
+}
+
+// NestedTransactionNotSupportedError is returned when the data source cannot nest a transaction in the current one.
+type NestedTransactionNotSupportedError struct {
+	Backend string
+}
+
+func (e *NestedTransactionNotSupportedError) Error() string {
+	return fmt.Sprintf("%s doesn't support nested transaction", e.Backend)
+}
+
+// CompositeMember is the transactor composed by the CompositeTransactor.
+type CompositeMember struct {
+	// Name is used by OptionFor, RegisterCompensation and CompositeError.
+	// OptionFor matches only the Name because the backend is unknown until the transaction begins.
+	// RegisterCompensation and CompositeError use the backend of the transaction if the Name is empty.
+	Name       string
+	Transactor Transactor
+	// CommitOrder decides the order of the commit. The member of the smallest order is committed first,
+	// so the most reliable data source should have the largest order.
+	CommitOrder int
+	// ReadOnly makes the transaction read-only. The member is excluded from the compensation because it has nothing to commit.
+	ReadOnly bool
+	// Options are applied only to this member.
+	Options []Option
+}
+
+func (m CompositeMember) options(options []Option) []Option {
+	var result []Option
+	var memberOptions []Option
+	for _, opt := range options {
+		if o, ok := opt.(MemberOption); ok {
+			if o.Name == m.Name {
+				memberOptions = append(memberOptions, o.Options...)
+			}
+			continue
+		}
+		result = append(result, opt)
+	}
+	result = append(result, m.Options...)
+	result = append(result, memberOptions...)
+	if m.ReadOnly {
+		result = append(result, OptionReadOnly())
+	}
+	return result
+}
+
+// options only for the named member of the CompositeTransactor
+type MemberOption struct {
+	Name    string
+	Options []Option
+}
+
+// Apply does nothing because the CompositeTransactor passes the options to the member.
+func (o MemberOption) Apply(_ *Config) {
+}
+
+func OptionFor(name string, options ...Option) MemberOption {
+	return MemberOption{Name: name, Options: options}
 }
 
 type CompositeTransactor struct {
-	transactors []Transactor
+	// sorted by CommitOrder
+	members []CompositeMember
 }
 
+// NewCompositeTransactor commits the first transactor first and the last transactor last.
 func NewCompositeTransactor(transactors ...Transactor) *CompositeTransactor {
-	return &CompositeTransactor{
-		transactors: transactors,
+	members := make([]CompositeMember, len(transactors))
+	for i, transactor := range transactors {
+		members[i] = CompositeMember{
+			Transactor:  transactor,
+			CommitOrder: i,
+		}
 	}
+	return NewCompositeTransactorWithMembers(members...)
 }
 
-func (t *CompositeTransactor) Required(ctx context.Context, fn DoInTransaction, options ...Option) error {
-	composed := fn
-	for _, transactor := range t.transactors {
-		composed = t.composeRequired(transactor, composed, options...)
+// NewCompositeTransactorWithMembers commits the members in the ascending order of CommitOrder.
+func NewCompositeTransactorWithMembers(members ...CompositeMember) *CompositeTransactor {
+	sorted := append([]CompositeMember(nil), members...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CommitOrder < sorted[j].CommitOrder
+	})
+	return &CompositeTransactor{
+		members: sorted,
 	}
-	return composed(ctx)
 }
 
-func (t *CompositeTransactor) composeRequired(a Transactor, composed DoInTransaction, options ...Option) DoInTransaction {
-	return func(ctx context.Context) error {
-		return a.Required(ctx, func(ctx context.Context) error {
-			return composed(ctx)
-		}, options...)
-	}
+type propagation func(t Transactor, ctx context.Context, fn DoInTransaction, options ...Option) error
+
+func (t *CompositeTransactor) Required(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.Required, fn, options...)(ctx)
 }
 
 func (t *CompositeTransactor) RequiresNew(ctx context.Context, fn DoInTransaction, options ...Option) error {
-	composed := fn
-	for _, transactor := range t.transactors {
-		composed = t.composeRequiresNew(transactor, composed, options...)
+	return t.compose(Transactor.RequiresNew, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) Supports(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.Supports, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) Mandatory(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.Mandatory, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) Never(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.Never, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) NotSupported(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.NotSupported, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) Nested(ctx context.Context, fn DoInTransaction, options ...Option) error {
+	return t.compose(Transactor.Nested, fn, options...)(ctx)
+}
+
+func (t *CompositeTransactor) compose(p propagation, fn DoInTransaction, options ...Option) DoInTransaction {
+	members := make([]*compositeMember, len(t.members))
+	for i, member := range t.members {
+		members[i] = &compositeMember{
+			name:     member.Name,
+			readOnly: member.ReadOnly,
+		}
+	}
+	composed := func(ctx context.Context) error {
+		status := newCompositeStatus(members)
+		if status == nil {
+			return fn(ctx)
+		}
+		return fn(WithStatus(ctx, status))
+	}
+	// the first member is the innermost transaction, which is committed first.
+	for i, member := range t.members {
+		composed = t.composeOne(p, member.Transactor, composed, members[i], member.options(options)...)
+	}
+	outermost := composed
+	return func(ctx context.Context) error {
+		err := outermost(ctx)
+		if err == nil {
+			return nil
+		}
+		return compensate(ctx, members, err)
 	}
-	return composed(ctx)
 }
 
-func (t *CompositeTransactor) composeRequiresNew(a Transactor, composed DoInTransaction, options ...Option) DoInTransaction {
+func (t *CompositeTransactor) composeOne(p propagation, a Transactor, composed DoInTransaction, member *compositeMember, options ...Option) DoInTransaction {
 	return func(ctx context.Context) error {
-		return a.RequiresNew(ctx, func(ctx context.Context) error {
+		return p(a, ctx, func(ctx context.Context) error {
+			// the transactor may run the function again like spanner.
+			member.reset(CurrentStatus(ctx))
 			return composed(ctx)
 		}, options...)
 	}